@@ -454,8 +454,8 @@ func (e *Engine) processThresholds() (shouldAbort bool) {
 		e.logger.WithField("m", m.Name).Debug("running thresholds")
 		succ, err := m.Thresholds.Run(m.Sink, t)
 		if err != nil {
+			// thresholds that can't be evaluated, e.g. because of a NaN sink value, fail
 			e.logger.WithField("m", m.Name).WithError(err).Error("Threshold error")
-			continue
 		}
 		if !succ {
 			e.logger.WithField("m", m.Name).Debug("Thresholds failed")
@@ -378,6 +378,24 @@ func TestEngine_processThresholds(t *testing.T) {
 	}
 }
 
+func TestEngine_processThresholdsWithoutSamples(t *testing.T) {
+	t.Parallel()
+	ths, err := stats.NewThresholds([]string{"rate>0.95"})
+	require.NoError(t, err)
+
+	e, _, wait := newTestEngine(t, nil, nil, nil, lib.Options{})
+	defer wait()
+
+	metric := stats.New("my_rate", stats.Rate)
+	metric.Thresholds = ths
+	e.Metrics[metric.Name] = metric
+
+	assert.False(t, e.processThresholds())
+	assert.True(t, e.IsTainted())
+	assert.True(t, metric.Tainted.Bool)
+	assert.True(t, metric.Thresholds.Thresholds[0].LastFailed)
+}
+
 func getMetricSum(mo *mockoutput.MockOutput, name string) (result float64) {
 	for _, sc := range mo.SampleContainers {
 		for _, s := range sc.GetSamples() {
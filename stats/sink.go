@@ -41,13 +41,24 @@ type Sink interface {
 	Format(t time.Duration) map[string]float64 // Data for thresholds.
 }
 
+// PercentileSink is an optional interface for sinks that can calculate percentiles on demand, used
+// by thresholds for the percentiles that aren't part of the formatted sink values
+type PercentileSink interface {
+	Sink
+	// Percentile returns the provided percentile, from 0 to 1, and whether it could be calculated
+	Percentile(p float64) (float64, bool)
+}
+
 type CounterSink struct {
 	Value float64
 	First time.Time
+	// Samples is the number of samples added to the sink, as Value is their sum
+	Samples uint64
 }
 
 func (c *CounterSink) Add(s Sample) {
 	c.Value += s.Value
+	c.Samples++
 	if c.First.IsZero() {
 		c.First = s.Time
 	}
@@ -66,10 +77,13 @@ type GaugeSink struct {
 	Value    float64
 	Max, Min float64
 	minSet   bool
+	// Samples is the number of samples added to the sink
+	Samples uint64
 }
 
 func (g *GaugeSink) Add(s Sample) {
 	g.Value = s.Value
+	g.Samples++
 	if s.Value > g.Max {
 		g.Max = s.Value
 	}
@@ -45,6 +45,7 @@ func TestCounterSink(t *testing.T) {
 				sink.Add(Sample{Metric: &Metric{}, Value: s, Time: now})
 			}
 			assert.Equal(t, 145.0, sink.Value)
+			assert.Equal(t, uint64(len(samples10)), sink.Samples)
 			assert.Equal(t, now, sink.First)
 		})
 	})
@@ -84,6 +85,7 @@ func TestGaugeSink(t *testing.T) {
 			assert.Equal(t, 1.0, sink.Min)
 			assert.Equal(t, true, sink.minSet)
 			assert.Equal(t, 10.0, sink.Max)
+			assert.Equal(t, uint64(len(samples6)), sink.Samples)
 		})
 	})
 	t.Run("calc", func(t *testing.T) {
@@ -22,22 +22,58 @@ package stats
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/file"
+	"github.com/dop251/goja/parser"
+	"github.com/dop251/goja/token"
+	"gopkg.in/guregu/null.v3"
 
 	"go.k6.io/k6/lib/types"
 )
 
+// jsEnvSrc defines the helpers available to threshold sources. Percentiles are calculated from the
+// sink by p() on every call if it supports it, instead of being looked up by key, so any number of
+// decimal places can be used and p(95.5) and p(95.50) are the same threshold. For other sinks,
+// they're looked up in the sink values by comparing the numbers, so p(95) matches a "p(95.0)" key,
+// or calculated by sinks implementing PercentileSink when they're not part of the values.
+//
+// As == and === compare floats exactly, approx(a, b[, epsilon]) can be used to check that two values
+// are equal within a relative tolerance, which defaults to 1e-6. Thresholds that are a single ==
+// comparison can also be configured with an epsilon instead.
 const jsEnvSrc = `
 function p(pct) {
-	return __sink__.P(pct/100.0);
+	return __percentile__(pct);
+};
+
+function approx(a, b, epsilon) {
+	if (epsilon === undefined) {
+		epsilon = 1e-6;
+	}
+	return Math.abs(a - b) <= epsilon * Math.max(Math.abs(a), Math.abs(b));
 };
 `
 
-var jsEnv *goja.Program
+var (
+	jsEnv *goja.Program
+
+	// builtinNames are the builtin JS globals and the helpers available to the thresholds, as
+	// opposed to sink values
+	builtinNames map[string]bool
+)
 
 func init() {
 	pgm, err := goja.Compile("__env__", jsEnvSrc, true)
@@ -45,6 +81,20 @@ func init() {
 		panic(err)
 	}
 	jsEnv = pgm
+
+	rt := goja.New()
+	if _, err := rt.RunProgram(jsEnv); err != nil {
+		panic(err)
+	}
+	names, err := rt.RunString(
+		`Object.getOwnPropertyNames(this).concat(Object.getOwnPropertyNames(Object.getPrototypeOf(this)))`)
+	if err != nil {
+		panic(err)
+	}
+	builtinNames = map[string]bool{"baseline": true, "metric": true, "change": true}
+	for _, name := range names.Export().([]interface{}) {
+		builtinNames[name.(string)] = true
+	}
 }
 
 // Threshold is a representation of a single threshold for a single metric
@@ -56,29 +106,220 @@ type Threshold struct {
 	// AbortOnFail marks if a given threshold fails that the whole test should be aborted
 	AbortOnFail bool
 	// AbortGracePeriod is a the minimum amount of time a test should be running before a failing
-	// this threshold will abort the test
+	// this threshold will abort the test. The test has to be running for strictly longer than it,
+	// so a failure exactly at the end of the grace period doesn't abort it yet.
 	AbortGracePeriod types.NullDuration
+	// Interval marks if the threshold should be evaluated against the change of the sink values
+	// since the previous run, instead of against their cumulative values. Only additive values, i.e.
+	// count, can be used by such thresholds, as the change of e.g. avg isn't the average of the
+	// samples since the previous run.
+	Interval bool
+	// MinSamples is the number of samples a metric needs to have before the threshold is evaluated.
+	// For sinks that don't keep track of their samples, like DummySink, and for RunWithValues, the
+	// count value is used as the number of samples if there is one, and MinSamples and RequireSamples
+	// are ignored otherwise.
+	MinSamples int64
+	// InsufficientData marks if the threshold wasn't evaluated in the last run, as the metric didn't
+	// have MinSamples samples yet, in which case it's considered neither passing nor failing
+	InsufficientData bool
+	// RequireSamples marks if the threshold should fail when the metric doesn't have any samples,
+	// instead of being evaluated against the default sink values. Use MinSamples to skip it instead.
+	RequireSamples bool
+	// Direction is whether lower or higher values are better for the threshold, if configured.
+	// ResultDirection infers it from the operator otherwise.
+	Direction ThresholdDirection
+	// Epsilon is the relative tolerance a threshold that is a single == comparison, like avg==100,
+	// passes with. It's exact if it's 0, and === is always exact.
+	Epsilon float64
 
 	pgm *goja.Program
 	rt  *goja.Runtime
+	// index is the position of the threshold in the config it was created from
+	index int
+	// observed and target are the two sides of the threshold and comparison its operator, if it's a
+	// single comparison
+	observed, target *goja.Program
+	comparison       string
+	// slackSign is 1 if the sink value of a single comparison is on its left, -1 if it's on its
+	// right, like in `200 > p(95)`, and 0 if neither side is a sink value and there's no slack
+	slackSign float64
+	// lastSlack is the slack of the last run, which is only calculated by RunDetailed
+	lastSlack null.Float
+	// method and operator are the sink value and the operator of the threshold, if it's a single
+	// comparison with a sink value on the left, like p(95) and < for `p(95) < 200`
+	method, operator string
+	// evaluator replaces the operator when comparing the two sides, if set
+	evaluator ThresholdEvaluator
+	// rawConfig is the JSON this threshold was unmarshalled from, retained only if it contained
+	// fields unknown to this version, so they can survive an unmarshal/marshal round-trip
+	rawConfig json.RawMessage
+	// tags are arbitrary labels of the threshold, e.g. for routing its results, which don't
+	// affect its evaluation
+	tags map[string]string
 }
 
 func newThreshold(src string, newThreshold *goja.Runtime, abortOnFail bool, gracePeriod types.NullDuration) (*Threshold, error) {
-	pgm, err := goja.Compile("__threshold__", src, true)
+	expanded, expr, err := parseThreshold(src)
+	if err != nil {
+		return nil, err
+	}
+	pgm, err := goja.Compile("__threshold__", expanded, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Threshold{
+	t := &Threshold{
 		Source:           src,
 		AbortOnFail:      abortOnFail,
 		AbortGracePeriod: gracePeriod,
 		pgm:              pgm,
 		rt:               newThreshold,
-	}, nil
+	}
+	if expr != nil {
+		if err := checkConstantTarget(expr); err != nil {
+			return nil, err
+		}
+		t.setComparison(expanded, expr)
+	}
+	return t, nil
+}
+
+// parseThreshold parses the provided source once, returning it with several percentiles expanded
+// by expandPercentiles and its comparison, if it's a single one. Syntax errors aren't returned, as
+// they're reported when the source is compiled.
+func parseThreshold(src string) (string, *ast.BinaryExpression, error) {
+	program, err := parser.ParseFile(nil, "", src, 0)
+	if err != nil {
+		return src, nil, nil
+	}
+	expr := comparisonExpression(program)
+	expanded, err := expandPercentiles(src, program, expr)
+	if err != nil {
+		return "", nil, err
+	}
+	if expanded != src {
+		return expanded, nil, nil // it's several comparisons now
+	}
+	return src, expr, nil
+}
+
+// setComparison sets up the threshold for the provided single comparison of its source, compiling
+// its sides separately and finding the sink value in it
+func (t *Threshold) setComparison(src string, expr *ast.BinaryExpression) {
+	observedSrc := src[offset(expr.Left.Idx0()):offset(expr.Left.Idx1())]
+	targetSrc := src[offset(expr.Right.Idx0()):offset(expr.Right.Idx1())]
+	observed, err := goja.Compile("__observed__", observedSrc, true)
+	if err != nil {
+		return
+	}
+	target, err := goja.Compile("__target__", targetSrc, true)
+	if err != nil {
+		return
+	}
+	t.observed, t.target, t.comparison = observed, target, expr.Operator.String()
+
+	if method, ok := comparedMethod(expr.Left); ok {
+		t.method, t.operator = method, t.comparison
+		t.slackSign = 1
+	} else if _, ok := comparedMethod(expr.Right); ok {
+		t.slackSign = -1
+	}
+}
+
+// expandPercentiles rewrites a comparison of several percentiles, like `p(90,95,99) < 300`, into
+// a comparison for each of them that all have to pass, i.e. `p(90)<300 && p(95)<300 && p(99)<300`.
+// Any other source is returned unchanged. The program is the parsed source, with expr being its
+// single comparison, if it's one.
+func expandPercentiles(src string, program *ast.Program, expr *ast.BinaryExpression) (string, error) {
+	var calls []*ast.CallExpression
+	walkAST(reflect.ValueOf(program), func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpression); ok && len(call.ArgumentList) > 1 {
+			if callee, ok := call.Callee.(*ast.Identifier); ok && callee.Name == "p" {
+				calls = append(calls, call)
+			}
+		}
+		return true
+	})
+	if len(calls) == 0 {
+		return src, nil
+	}
+
+	call := calls[0]
+	if len(calls) > 1 || expr == nil || (expr.Left != ast.Expression(call) && expr.Right != ast.Expression(call)) {
+		return "", errors.New("p() with several percentiles is only supported as a side of a single " +
+			"comparison, like p(90,95,99) < 300")
+	}
+
+	start := offset(expr.Idx0())
+	exprSrc := src[start:offset(expr.Idx1())]
+	callStart, callEnd := offset(call.Idx0())-start, offset(call.Idx1())-start
+	parts := make([]string, len(call.ArgumentList))
+	for i, arg := range call.ArgumentList {
+		lit, ok := arg.(*ast.NumberLiteral)
+		if !ok {
+			return "", errors.New("p() with several percentiles only supports number literals")
+		}
+		parts[i] = exprSrc[:callStart] + "p(" + lit.Literal + ")" + exprSrc[callEnd:]
+	}
+	return strings.Join(parts, " && "), nil
+}
+
+// checkConstantTarget returns an error if the provided single comparison has constant arithmetic
+// on either side, like `rate < 1/1000` or `1/1000 > rate`, that doesn't evaluate to a finite
+// number, e.g. because of a division by zero
+func checkConstantTarget(expr *ast.BinaryExpression) error {
+	for _, side := range []ast.Expression{expr.Left, expr.Right} {
+		v, ok := foldConstant(side)
+		if ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			return fmt.Errorf("the target of the threshold is %v and can't be compared", v)
+		}
+	}
+	return nil
+}
+
+// foldConstant returns the value of an expression that only consists of arithmetic on number
+// literals, and whether it's such an expression
+func foldConstant(expr ast.Expression) (float64, bool) {
+	switch e := expr.(type) {
+	case *ast.NumberLiteral:
+		return numberValue(e)
+	case *ast.UnaryExpression:
+		v, ok := foldConstant(e.Operand)
+		switch e.Operator {
+		case token.MINUS:
+			return -v, ok
+		case token.PLUS:
+			return v, ok
+		}
+	case *ast.BinaryExpression:
+		l, lok := foldConstant(e.Left)
+		r, rok := foldConstant(e.Right)
+		if !lok || !rok {
+			return 0, false
+		}
+		switch e.Operator {
+		case token.PLUS:
+			return l + r, true
+		case token.MINUS:
+			return l - r, true
+		case token.MULTIPLY:
+			return l * r, true
+		case token.SLASH:
+			return l / r, true
+		case token.REMAINDER:
+			return math.Mod(l, r), true
+		}
+	}
+	return 0, false
 }
 
 func (t Threshold) runNoTaint() (bool, error) {
+	if t.evaluator != nil {
+		return t.runEvaluator(t.evaluator)
+	}
+	if t.Epsilon > 0 && t.comparison == "==" {
+		return t.runEvaluator(t.approxEqual)
+	}
 	v, err := t.rt.RunProgram(t.pgm)
 	if err != nil {
 		return false, err
@@ -86,16 +327,194 @@ func (t Threshold) runNoTaint() (bool, error) {
 	return v.ToBoolean(), nil
 }
 
+func (t Threshold) runEvaluator(evaluator ThresholdEvaluator) (bool, error) {
+	observed, err := t.rt.RunProgram(t.observed)
+	if err != nil {
+		return false, err
+	}
+	target, err := t.rt.RunProgram(t.target)
+	if err != nil {
+		return false, err
+	}
+	return evaluator(observed.ToFloat(), target.ToFloat(), t.comparison)
+}
+
+// approxEqual is the evaluator of == comparisons with an Epsilon, like approx() with it
+func (t Threshold) approxEqual(lhs, rhs float64, _ string) (bool, error) {
+	return math.Abs(lhs-rhs) <= t.Epsilon*math.Max(math.Abs(lhs), math.Abs(rhs)), nil
+}
+
 func (t *Threshold) run() (bool, error) {
 	b, err := t.runNoTaint()
 	t.LastFailed = !b
 	return b, err
 }
 
+// comparisonExpression returns the comparison the program consists of, or nil if it's anything else
+func comparisonExpression(program *ast.Program) *ast.BinaryExpression {
+	if len(program.Body) != 1 {
+		return nil
+	}
+	stmt, ok := program.Body[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	expr, ok := stmt.Expression.(*ast.BinaryExpression)
+	if !ok || !expr.Comparison || !isSupportedOperator(expr.Operator.String()) {
+		return nil
+	}
+	return expr
+}
+
+// offset converts a position in a source parsed without a file set, which is 1-based, to an offset
+func offset(idx file.Idx) int {
+	return int(idx) - 1
+}
+
+// slack returns the signed difference between the observed sink value and the target of a threshold
+// that is a single comparison, on whichever side the sink value is, so it's negative when the
+// observed value is below the target
+func (t Threshold) slack() null.Float {
+	if t.observed == nil || t.slackSign == 0 {
+		return null.Float{}
+	}
+	observed, err := t.rt.RunProgram(t.observed)
+	if err != nil {
+		return null.Float{}
+	}
+	target, err := t.rt.RunProgram(t.target)
+	if err != nil {
+		return null.Float{}
+	}
+	return null.FloatFrom(t.slackSign * (observed.ToFloat() - target.ToFloat()))
+}
+
+// Evaluate checks the threshold against the provided value without needing a Sink, by using it
+// for every sink value the threshold references, including all percentiles. Like Run, it uses the
+// evaluator set with SetEvaluator, if any. It doesn't change LastFailed.
+func (t *Threshold) Evaluate(value float64) (bool, error) {
+	rt := goja.New()
+	if _, err := rt.RunProgram(jsEnv); err != nil {
+		return false, fmt.Errorf("threshold builtin error: %w", err)
+	}
+
+	methods := make(map[string]struct{})
+	t.aggregationMethods(methods)
+	values := make(map[string]float64, len(methods))
+	for method := range methods {
+		values[method] = value
+	}
+	vm := &Thresholds{Runtime: rt}
+	if err := vm.setSinkValues(values); err != nil {
+		return false, err
+	}
+	rt.Set("p", func(float64) float64 { return value })
+
+	evaluated := *t
+	evaluated.rt = rt
+	return evaluated.runNoTaint()
+}
+
+// Index returns the position of the threshold in the list of thresholds of the metric it was
+// configured in, which stays the same even if other thresholds were skipped.
+func (t *Threshold) Index() int {
+	return t.index
+}
+
+// Possible values for ThresholdDirection.
+const (
+	UnknownDirection = ThresholdDirection(iota) // Not configured, or can't be inferred
+	LowerIsBetter                               // Lower values are better, e.g. for p(95)<200
+	HigherIsBetter                              // Higher values are better, e.g. for rate>0.99
+)
+
+const (
+	lowerIsBetterString  = "lower"
+	higherIsBetterString = "higher"
+)
+
+// ErrInvalidThresholdDirection is returned for an invalid serialized threshold direction
+var ErrInvalidThresholdDirection = errors.New("invalid threshold direction")
+
+// ThresholdDirection specifies whether lower or higher values are better for a threshold, e.g. for
+// reporting its results
+type ThresholdDirection int
+
+// MarshalText serializes a ThresholdDirection as a human readable string.
+func (d ThresholdDirection) MarshalText() ([]byte, error) {
+	switch d {
+	case LowerIsBetter:
+		return []byte(lowerIsBetterString), nil
+	case HigherIsBetter:
+		return []byte(higherIsBetterString), nil
+	default:
+		return nil, ErrInvalidThresholdDirection
+	}
+}
+
+// UnmarshalText deserializes a ThresholdDirection from a string representation.
+func (d *ThresholdDirection) UnmarshalText(data []byte) error {
+	switch string(data) {
+	case lowerIsBetterString:
+		*d = LowerIsBetter
+	case higherIsBetterString:
+		*d = HigherIsBetter
+	default:
+		return ErrInvalidThresholdDirection
+	}
+	return nil
+}
+
+func (d ThresholdDirection) String() string {
+	switch d {
+	case LowerIsBetter:
+		return lowerIsBetterString
+	case HigherIsBetter:
+		return higherIsBetterString
+	default:
+		return "[UNKNOWN]"
+	}
+}
+
+// ResultDirection returns the configured Direction of the threshold or, if there's none, infers it
+// from the operator of a comparison with the sink value on the left, e.g. LowerIsBetter for
+// `p(95) < 200`. It's UnknownDirection for any other threshold.
+func (t *Threshold) ResultDirection() ThresholdDirection {
+	if t.Direction != UnknownDirection {
+		return t.Direction
+	}
+	switch t.operator {
+	case "<", "<=":
+		return LowerIsBetter
+	case ">", ">=":
+		return HigherIsBetter
+	default:
+		return UnknownDirection
+	}
+}
+
+// Tags returns a copy of the labels the threshold was configured with, or nil if it has none
+func (t *Threshold) Tags() map[string]string {
+	if t.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(t.tags))
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
 type thresholdConfig struct {
 	Threshold        string             `json:"threshold"`
 	AbortOnFail      bool               `json:"abortOnFail"`
 	AbortGracePeriod types.NullDuration `json:"delayAbortEval"`
+	Interval         bool               `json:"interval,omitempty"`
+	MinSamples       int64              `json:"minSamples,omitempty"`
+	RequireSamples   bool               `json:"requireSamples,omitempty"`
+	Tags             map[string]string  `json:"tags,omitempty"`
+	Direction        ThresholdDirection `json:"direction,omitempty"`
+	Epsilon          float64            `json:"epsilon,omitempty"`
 }
 
 //used internally for JSON marshalling
@@ -111,9 +530,28 @@ func (tc *thresholdConfig) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, rawConfig)
 }
 
+// hasUnknownFields returns whether the provided JSON threshold config is an object with fields
+// that aren't part of thresholdConfig
+func hasUnknownFields(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	for name := range fields {
+		switch name {
+		case "threshold", "abortOnFail", "delayAbortEval", "interval", "minSamples",
+			"requireSamples", "tags", "direction", "epsilon":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
 func (tc thresholdConfig) MarshalJSON() ([]byte, error) {
 	var data interface{} = tc.Threshold
-	if tc.AbortOnFail {
+	if tc.AbortOnFail || tc.Interval || tc.MinSamples > 0 || tc.RequireSamples || len(tc.Tags) > 0 ||
+		tc.Direction != UnknownDirection || tc.Epsilon != 0 {
 		data = rawThresholdConfig(tc)
 	}
 
@@ -125,6 +563,15 @@ type Thresholds struct {
 	Runtime    *goja.Runtime
 	Thresholds []*Threshold
 	Abort      bool
+	// ReportOnly disables aborting the test when thresholds fail, regardless of their AbortOnFail
+	ReportOnly bool
+
+	// sink values from the previous and the current run, used for interval thresholds
+	previous, current map[string]float64
+	// the number of samples of the metric in the current run, invalid if it isn't known
+	samples null.Float
+	// detailed marks if the slack of the thresholds should be calculated, as RunDetailed does
+	detailed bool
 }
 
 // NewThresholds returns Thresholds objects representing the provided source strings
@@ -137,103 +584,1626 @@ func NewThresholds(sources []string) (Thresholds, error) {
 	return newThresholdsWithConfig(tcs)
 }
 
-func newThresholdsWithConfig(configs []thresholdConfig) (Thresholds, error) {
-	rt := goja.New()
-	if _, err := rt.RunProgram(jsEnv); err != nil {
-		return Thresholds{}, fmt.Errorf("threshold builtin error: %w", err)
+// NewThresholdsFromInterface returns Thresholds from an already decoded generic config, e.g. the
+// result of decoding YAML or JSON into an interface{}, without going through JSON again. It accepts
+// the same shapes as UnmarshalJSON: a list of source strings and/or config objects.
+func NewThresholdsFromInterface(v interface{}) (Thresholds, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return Thresholds{}, fmt.Errorf("thresholds should be a list, got %T", v)
 	}
-
-	ts := make([]*Threshold, len(configs))
-	for i, config := range configs {
-		t, err := newThreshold(config.Threshold, rt, config.AbortOnFail, config.AbortGracePeriod)
+	configs := make([]thresholdConfig, len(items))
+	for i, item := range items {
+		config, err := thresholdConfigFromInterface(item)
 		if err != nil {
 			return Thresholds{}, fmt.Errorf("threshold %d error: %w", i, err)
 		}
-		ts[i] = t
+		configs[i] = config
+	}
+	return newThresholdsWithConfig(configs)
+}
+
+func thresholdConfigFromInterface(v interface{}) (thresholdConfig, error) {
+	var fields map[string]interface{}
+	switch val := v.(type) {
+	case string:
+		return thresholdConfig{Threshold: val}, nil
+	case map[string]interface{}:
+		fields = val
+	case map[interface{}]interface{}:
+		fields = make(map[string]interface{}, len(val))
+		for k, fv := range val {
+			name, ok := k.(string)
+			if !ok {
+				return thresholdConfig{}, fmt.Errorf("invalid field name %v", k)
+			}
+			fields[name] = fv
+		}
+	default:
+		return thresholdConfig{}, fmt.Errorf("invalid threshold config type %T", v)
+	}
+
+	var tc thresholdConfig
+	for name, fv := range fields {
+		var ok bool
+		switch name {
+		case "threshold":
+			tc.Threshold, ok = fv.(string)
+		case "abortOnFail":
+			tc.AbortOnFail, ok = fv.(bool)
+		case "interval":
+			tc.Interval, ok = fv.(bool)
+		case "delayAbortEval":
+			tc.AbortGracePeriod, ok = nullDurationFromInterface(fv)
+		case "minSamples":
+			tc.MinSamples, ok = int64FromInterface(fv)
+		case "requireSamples":
+			tc.RequireSamples, ok = fv.(bool)
+		case "tags":
+			tc.Tags, ok = tagsFromInterface(fv)
+		case "epsilon":
+			tc.Epsilon, ok = float64FromInterface(fv)
+		case "direction":
+			var direction string
+			if direction, ok = fv.(string); ok {
+				ok = tc.Direction.UnmarshalText([]byte(direction)) == nil
+			}
+		default:
+			ok = true // ignored, as with JSON
+		}
+		if !ok {
+			return thresholdConfig{}, fmt.Errorf("invalid value %v for %s", fv, name)
+		}
 	}
+	return tc, nil
+}
 
-	return Thresholds{rt, ts, false}, nil
+func tagsFromInterface(v interface{}) (map[string]string, bool) {
+	switch val := v.(type) {
+	case nil:
+		return nil, true
+	case map[string]string:
+		return val, true
+	case map[string]interface{}:
+		tags := make(map[string]string, len(val))
+		for k, tv := range val {
+			s, ok := tv.(string)
+			if !ok {
+				return nil, false
+			}
+			tags[k] = s
+		}
+		return tags, true
+	case map[interface{}]interface{}:
+		tags := make(map[string]string, len(val))
+		for k, tv := range val {
+			name, ok := k.(string)
+			s, isString := tv.(string)
+			if !ok || !isString {
+				return nil, false
+			}
+			tags[name] = s
+		}
+		return tags, true
+	default:
+		return nil, false
+	}
 }
 
-func (ts *Thresholds) updateVM(sink Sink, t time.Duration) error {
-	ts.Runtime.Set("__sink__", sink)
-	f := sink.Format(t)
-	for k, v := range f {
-		ts.Runtime.Set(k, v)
+func nullDurationFromInterface(v interface{}) (types.NullDuration, bool) {
+	switch val := v.(type) {
+	case nil:
+		return types.NullDuration{}, true
+	case string:
+		d, err := types.ParseExtendedDuration(val)
+		return types.NullDurationFrom(d), err == nil
+	default:
+		// numbers are milliseconds, as in JSON
+		ms, ok := float64FromInterface(v)
+		return types.NullDurationFrom(time.Duration(ms * float64(time.Millisecond))), ok
 	}
-	return nil
 }
 
-func (ts *Thresholds) runAll(t time.Duration) (bool, error) {
-	succ := true
-	for i, th := range ts.Thresholds {
-		b, err := th.run()
-		if err != nil {
-			return false, fmt.Errorf("threshold %d run error: %w", i, err)
+func int64FromInterface(v interface{}) (int64, bool) {
+	f, ok := float64FromInterface(v)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func float64FromInterface(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case float64:
+		return val, true
+	default:
+		return 0, false
+	}
+}
+
+// ValidateThresholdSources checks that every provided source is a valid threshold, without creating
+// the Thresholds. The returned errors are in the same positions as the sources, nil for valid ones.
+// A source is valid if and only if NewThresholds accepts it.
+func ValidateThresholdSources(sources []string) []error {
+	errs := make([]error, len(sources))
+	for i, src := range sources {
+		if _, err := newThreshold(src, nil, false, types.NullDuration{}); err != nil {
+			errs[i] = fmt.Errorf("threshold %d error: %w", i, err)
 		}
-		if !b {
-			succ = false
+	}
+	return errs
+}
 
-			if ts.Abort || !th.AbortOnFail {
-				continue
-			}
+// Clone returns a deep copy of the thresholds, with their own JS runtime, so the copy can be changed
+// and run independently. The baseline and metric resolver aren't copied and need to be set again.
+func (ts Thresholds) Clone() Thresholds {
+	rt := goja.New()
+	_, _ = rt.RunProgram(jsEnv) // it only declares functions, so it can't fail
 
-			ts.Abort = !th.AbortGracePeriod.Valid ||
-				th.AbortGracePeriod.Duration < types.Duration(t)
+	clone := ts
+	clone.Runtime = rt
+	clone.previous = copyValues(ts.previous)
+	clone.current = copyValues(ts.current)
+	if ts.Thresholds != nil {
+		clone.Thresholds = make([]*Threshold, len(ts.Thresholds))
+	}
+	for i, t := range ts.Thresholds {
+		clone.Thresholds[i] = t.copyTo(rt)
+	}
+	return clone
+}
+
+// copyTo returns a deep copy of the threshold that runs in the provided runtime
+func (t Threshold) copyTo(rt *goja.Runtime) *Threshold {
+	t.rt = rt
+	if t.rawConfig != nil {
+		t.rawConfig = append(json.RawMessage(nil), t.rawConfig...)
+	}
+	t.tags = t.Tags()
+	return &t
+}
+
+// Merge returns new thresholds with the thresholds of both ts and other, where the thresholds of
+// other replace those of ts comparing the same sink value with the same operator, or with the
+// same source if they aren't such a comparison. Replaced thresholds keep their position, while the
+// rest of other's are appended. Neither ts nor other are changed, and the result has its own JS
+// runtime without any run state, baseline or metric resolver.
+func (ts Thresholds) Merge(other Thresholds) Thresholds {
+	rt := goja.New()
+	_, _ = rt.RunProgram(jsEnv) // it only declares functions, so it can't fail
+
+	key := func(t *Threshold) string {
+		if t.method == "" {
+			return "source " + t.Source
 		}
+		return t.method + " " + t.operator
 	}
-	return succ, nil
+	positions := make(map[string]int, len(ts.Thresholds))
+	merged := make([]*Threshold, 0, len(ts.Thresholds)+len(other.Thresholds))
+	for _, t := range ts.Thresholds {
+		positions[key(t)] = len(merged)
+		merged = append(merged, t)
+	}
+	for _, t := range other.Thresholds {
+		if i, ok := positions[key(t)]; ok {
+			merged[i] = t
+			continue
+		}
+		positions[key(t)] = len(merged)
+		merged = append(merged, t)
+	}
+
+	for i, t := range merged {
+		merged[i] = t.copyTo(rt)
+		merged[i].index = i
+		merged[i].LastFailed, merged[i].InsufficientData, merged[i].lastSlack = false, false, null.Float{}
+	}
+	return Thresholds{Runtime: rt, Thresholds: merged, ReportOnly: ts.ReportOnly}
 }
 
-// Run processes all the thresholds with the provided Sink at the provided time and returns if any
-// of them fails
-func (ts *Thresholds) Run(sink Sink, t time.Duration) (bool, error) {
-	if err := ts.updateVM(sink, t); err != nil {
-		return false, err
+func copyValues(values map[string]float64) map[string]float64 {
+	if values == nil {
+		return nil
 	}
-	return ts.runAll(t)
+	c := make(map[string]float64, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
 }
 
-// UnmarshalJSON is implementation of json.Unmarshaler
-func (ts *Thresholds) UnmarshalJSON(data []byte) error {
-	var configs []thresholdConfig
-	if err := json.Unmarshal(data, &configs); err != nil {
-		return err
+// ThresholdsOptions configures the creation of Thresholds by NewThresholdsWithOptions
+type ThresholdsOptions struct {
+	// SkipUnknownMethods drops the thresholds that reference sink values no sink produces, with a
+	// warning, instead of keeping them and getting an error when they're run
+	SkipUnknownMethods bool
+	// RejectContradictions returns an error for thresholds that can never pass together, like
+	// p(95)<100 and p(95)>200. Only thresholds comparing a sink value with a number are checked.
+	RejectContradictions bool
+	// CommaDecimalSeparator accepts a comma as the decimal separator in number literals, as in
+	// rate<0,01. As a comma between two digits in the arguments of a call, like p(90,95), could be
+	// either, it's rejected, so they have to be separated by a comma and a space, as in p(90, 95).
+	// Strings and comments are left unchanged. The sources of the thresholds use dots.
+	CommaDecimalSeparator bool
+}
+
+var (
+	supportedOperators          = []string{"<", "<=", ">", ">=", "==", "===", "!=", "!=="}
+	supportedAggregationMethods = []string{"count", "rate", "value", "min", "max", "avg", "mean", "med"}
+
+	// knownAggregationMethods are the values produced by the sinks, apart from percentiles
+	knownAggregationMethods = func() map[string]bool {
+		methods := make(map[string]bool, len(supportedAggregationMethods))
+		for _, method := range supportedAggregationMethods {
+			methods[method] = true
+		}
+		return methods
+	}()
+)
+
+// SupportedOperators returns the operators a threshold can compare a sink value with, e.g. "<"
+func SupportedOperators() []string {
+	return append([]string(nil), supportedOperators...)
+}
+
+// SupportedAggregationMethods returns the names of the sink values thresholds can use, e.g. "avg".
+// Percentiles aren't included, as any of them can be used with the p(N) syntax, e.g. p(95).
+func SupportedAggregationMethods() []string {
+	return append([]string(nil), supportedAggregationMethods...)
+}
+
+func isSupportedOperator(op string) bool {
+	for _, supported := range supportedOperators {
+		if op == supported {
+			return true
+		}
 	}
-	newts, err := newThresholdsWithConfig(configs)
+	return false
+}
+
+// NewThresholdsWithOptions is like NewThresholds, but configurable with the provided options. It also
+// returns the warnings for the thresholds that were skipped.
+func NewThresholdsWithOptions(sources []string, opts ThresholdsOptions) (Thresholds, []string, error) {
+	if opts.CommaDecimalSeparator {
+		normalized := make([]string, len(sources))
+		var errs []error
+		for i, src := range sources {
+			var err error
+			if normalized[i], err = normalizeDecimalCommas(src); err != nil {
+				errs = append(errs, fmt.Errorf("threshold %d error: %w", i, err))
+			}
+		}
+		if err := joinThresholdErrors(errs); err != nil {
+			return Thresholds{}, nil, err
+		}
+		sources = normalized
+	}
+	ts, err := NewThresholds(sources)
 	if err != nil {
-		return err
+		return ts, nil, err
+	}
+	if opts.RejectContradictions {
+		if err := checkContradictions(ts.Thresholds); err != nil {
+			return Thresholds{}, nil, err
+		}
+	}
+	if !opts.SkipUnknownMethods {
+		return ts, nil, nil
 	}
-	*ts = newts
-	return nil
-}
 
-// MarshalJSON is implementation of json.Marshaler
-func (ts Thresholds) MarshalJSON() ([]byte, error) {
-	configs := make([]thresholdConfig, len(ts.Thresholds))
+	var warnings []string
+	kept := make([]*Threshold, 0, len(ts.Thresholds))
 	for i, t := range ts.Thresholds {
-		configs[i].Threshold = t.Source
-		configs[i].AbortOnFail = t.AbortOnFail
-		configs[i].AbortGracePeriod = t.AbortGracePeriod
+		methods := make(map[string]struct{})
+		t.aggregationMethods(methods)
+		var unknown []string
+		for method := range methods {
+			if !knownAggregationMethods[method] && !strings.HasPrefix(method, "p(") {
+				unknown = append(unknown, method)
+			}
+		}
+		if len(unknown) == 0 {
+			kept = append(kept, t)
+			continue
+		}
+		sort.Strings(unknown)
+		warnings = append(warnings, fmt.Sprintf("threshold %d (%s) was skipped, as it references the unknown %s",
+			i, t.Source, strings.Join(unknown, ", ")))
 	}
+	ts.Thresholds = kept
+	return ts, warnings, nil
+}
 
-	return MarshalJSONWithoutHTMLEscape(configs)
+// normalizeDecimalCommas replaces the commas used as decimal separators in the number literals of
+// the provided source with dots. Strings and comments are skipped, and a comma between two digits in
+// the arguments of a call is rejected, as it could also separate them.
+func normalizeDecimalCommas(src string) (string, error) {
+	normalized := []byte(src)
+	var calls []bool // whether every open parenthesis is the one of a call
+	var prev byte    // the last character that isn't whitespace, a string or a comment
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			i = stringEnd(src, i)
+		case strings.HasPrefix(src[i:], "/*"):
+			if end := strings.Index(src[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 1
+			} else {
+				i = len(src)
+			}
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			if end := strings.IndexAny(src[i:], "\n\r"); end >= 0 {
+				i += end
+			} else {
+				i = len(src)
+			}
+			continue
+		case c == '(':
+			calls = append(calls, isIdentifierChar(prev) || prev == ')' || prev == ']')
+		case c == ')' && len(calls) > 0:
+			calls = calls[:len(calls)-1]
+		case isDigit(c) && (i == 0 || !isIdentifierChar(src[i-1]) && src[i-1] != '.'):
+			start, separated := i, false
+			for i+1 < len(src) {
+				next := src[i+1]
+				if next == ',' && !separated && i+2 < len(src) && isDigit(src[i+2]) && isDigit(src[i]) {
+					if len(calls) > 0 && calls[len(calls)-1] {
+						end := i + 2
+						for end < len(src) && isDigit(src[end]) {
+							end++
+						}
+						return "", fmt.Errorf("%q in the arguments of a call is ambiguous with a decimal comma, "+
+							"separate the arguments with a comma and a space", src[start:end])
+					}
+					normalized[i+1], separated = '.', true
+				} else if next == '.' {
+					separated = true
+				} else if !isDigit(next) {
+					break
+				}
+				i++
+			}
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			prev = src[i]
+		}
+	}
+	return string(normalized), nil
 }
 
-// MarshalJSONWithoutHTMLEscape marshals t to JSON without escaping characters
-// for safe use in HTML.
-func MarshalJSONWithoutHTMLEscape(t interface{}) ([]byte, error) {
-	buffer := &bytes.Buffer{}
-	encoder := json.NewEncoder(buffer)
-	encoder.SetEscapeHTML(false)
-	err := encoder.Encode(t)
-	bytes := buffer.Bytes()
-	if err == nil && len(bytes) > 0 {
-		// Remove the newline appended by Encode() :-/
-		// See https://github.com/golang/go/issues/37083
-		bytes = bytes[:len(bytes)-1]
-	}
-	return bytes, err
+// stringEnd returns the position of the quote ending the string literal starting at i
+func stringEnd(src string, i int) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i
+		}
+	}
+	return len(src)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// valueRange is the range of values a sink value can have for a threshold to pass
+type valueRange struct {
+	min, max         float64
+	minIncl, maxIncl bool
+}
+
+// intersects returns whether there are values in both ranges
+func (r valueRange) intersects(o valueRange) bool {
+	lo, loIncl := r.min, r.minIncl
+	if o.min > lo || (o.min == lo && !o.minIncl) {
+		lo, loIncl = o.min, o.minIncl
+	}
+	hi, hiIncl := r.max, r.maxIncl
+	if o.max < hi || (o.max == hi && !o.maxIncl) {
+		hi, hiIncl = o.max, o.maxIncl
+	}
+	return lo < hi || (lo == hi && loIncl && hiIncl)
+}
+
+// passingRange returns the sink value a threshold compares with a number and the range of values
+// it passes for, if the threshold is such a comparison, e.g. p(95) and [-Inf, 200) for p(95)<200
+func (t Threshold) passingRange() (string, valueRange, bool) {
+	program, err := parser.ParseFile(nil, "", t.Source, 0)
+	if err != nil {
+		return "", valueRange{}, false
+	}
+	expr := comparisonExpression(program)
+	if expr == nil {
+		return "", valueRange{}, false
+	}
+
+	op := expr.Operator
+	method, ok := comparedMethod(expr.Left)
+	value, isNumber := numberValue(expr.Right)
+	if !ok || !isNumber {
+		// the number can also be on the left, as in 200>p(95), which is p(95)<200
+		method, ok = comparedMethod(expr.Right)
+		value, isNumber = numberValue(expr.Left)
+		if !ok || !isNumber {
+			return "", valueRange{}, false
+		}
+		switch op {
+		case token.LESS:
+			op = token.GREATER
+		case token.LESS_OR_EQUAL:
+			op = token.GREATER_OR_EQUAL
+		case token.GREATER:
+			op = token.LESS
+		case token.GREATER_OR_EQUAL:
+			op = token.LESS_OR_EQUAL
+		}
+	}
+
+	r := valueRange{min: math.Inf(-1), max: math.Inf(1), minIncl: true, maxIncl: true}
+	switch op {
+	case token.LESS:
+		r.max, r.maxIncl = value, false
+	case token.LESS_OR_EQUAL:
+		r.max = value
+	case token.GREATER:
+		r.min, r.minIncl = value, false
+	case token.GREATER_OR_EQUAL:
+		r.min = value
+	case token.EQUAL, token.STRICT_EQUAL:
+		r.min, r.max = value, value
+	default:
+		return "", valueRange{}, false
+	}
+	return method, r, true
+}
+
+// comparedMethod returns the sink value the expression consists of, e.g. avg or p(95)
+func comparedMethod(expr ast.Expression) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		name := e.Name.String()
+		if alias, ok := sinkValueAliases[name]; ok {
+			name = alias
+		}
+		return name, true
+	case *ast.CallExpression:
+		callee, ok := e.Callee.(*ast.Identifier)
+		if !ok {
+			return "", false
+		}
+		if pct, ok := percentileArgument(callee, e.ArgumentList); ok {
+			return fmt.Sprintf("p(%v)", pct), true
+		}
+	}
+	return "", false
+}
+
+// numberValue returns the value of a number literal, which can be negated
+func numberValue(expr ast.Expression) (float64, bool) {
+	switch e := expr.(type) {
+	case *ast.NumberLiteral:
+		switch v := e.Value.(type) {
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+	case *ast.UnaryExpression:
+		if e.Operator == token.MINUS {
+			v, ok := numberValue(e.Operand)
+			return -v, ok
+		}
+	}
+	return 0, false
+}
+
+// checkContradictions returns an error for every pair of thresholds comparing the same sink value
+// with numbers in a way they can't both pass, like p(95)<100 and p(95)>200
+func checkContradictions(thresholds []*Threshold) error {
+	type comparison struct {
+		index  int
+		method string
+		r      valueRange
+	}
+	comparisons := make([]comparison, 0, len(thresholds))
+	var msgs []string
+	for i, t := range thresholds {
+		method, r, ok := t.passingRange()
+		if !ok {
+			continue
+		}
+		for _, c := range comparisons {
+			if c.method == method && !c.r.intersects(r) {
+				msgs = append(msgs, fmt.Sprintf("thresholds %d (%s) and %d (%s) contradict each other, as %s can't satisfy both",
+					c.index, thresholds[c.index].Source, i, t.Source, method))
+			}
+		}
+		comparisons = append(comparisons, comparison{index: i, method: method, r: r})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// joinThresholdErrors returns nil for no errors, the error itself for a single one, or an error
+// listing all of them otherwise
+func joinThresholdErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return fmt.Errorf("%d invalid thresholds: %s", len(errs), strings.Join(msgs, "; "))
+	}
+}
+
+// metricTypeMethods are the values the sinks of each metric type produce, apart from percentiles,
+// which only trends have
+var metricTypeMethods = map[MetricType]map[string]bool{
+	Counter: {"count": true, "rate": true},
+	Gauge:   {"value": true},
+	Trend:   {"min": true, "max": true, "avg": true, "mean": true, "med": true},
+	Rate:    {"rate": true},
+}
+
+// NewThresholdsForMetricType is like NewThresholds, but also fails for thresholds using sink values
+// that metrics of the provided type never have, e.g. avg for a counter. Percentiles can only be
+// used with trends.
+func NewThresholdsForMetricType(sources []string, metricType MetricType) (Thresholds, error) {
+	methods, ok := metricTypeMethods[metricType]
+	if !ok {
+		return Thresholds{}, ErrInvalidMetricType
+	}
+	ts, err := NewThresholds(sources)
+	if err != nil {
+		return Thresholds{}, err
+	}
+
+	var errs []error
+	for i, t := range ts.Thresholds {
+		used := make(map[string]struct{})
+		t.aggregationMethods(used)
+		var unsupported []string
+		for method := range used {
+			isPercentile := strings.HasPrefix(method, "p(")
+			if !methods[method] && !(isPercentile && metricType == Trend) {
+				unsupported = append(unsupported, method)
+			}
+		}
+		if len(unsupported) > 0 {
+			sort.Strings(unsupported)
+			errs = append(errs, fmt.Errorf("threshold %d (%s) uses %s, which %s metrics don't have",
+				i, t.Source, strings.Join(unsupported, ", "), metricType))
+		}
+	}
+	if err := joinThresholdErrors(errs); err != nil {
+		return Thresholds{}, err
+	}
+	return ts, nil
+}
+
+// intervalMethods are the sink values that are additive, so their change since the previous run is
+// their value for the samples added since then
+var intervalMethods = map[string]bool{"count": true}
+
+// checkIntervalMethods returns an error if the threshold uses sink values that can't be used by
+// interval thresholds
+func checkIntervalMethods(t *Threshold) error {
+	used := make(map[string]struct{})
+	t.aggregationMethods(used)
+	var unsupported []string
+	for method := range used {
+		if !intervalMethods[method] {
+			unsupported = append(unsupported, method)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	sort.Strings(unsupported)
+	return fmt.Errorf("interval thresholds can only use count, not %s", strings.Join(unsupported, ", "))
+}
+
+func newThresholdsWithConfig(configs []thresholdConfig) (Thresholds, error) {
+	rt := goja.New()
+	if _, err := rt.RunProgram(jsEnv); err != nil {
+		return Thresholds{}, fmt.Errorf("threshold builtin error: %w", err)
+	}
+
+	ts := make([]*Threshold, len(configs))
+	var errs []error
+	for i, config := range configs {
+		if config.Epsilon < 0 || math.IsNaN(config.Epsilon) {
+			errs = append(errs, fmt.Errorf("threshold %d error: invalid epsilon %v", i, config.Epsilon))
+			continue
+		}
+		t, err := newThreshold(config.Threshold, rt, config.AbortOnFail, config.AbortGracePeriod)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("threshold %d error: %w", i, err))
+			continue
+		}
+		if config.Interval {
+			if err := checkIntervalMethods(t); err != nil {
+				errs = append(errs, fmt.Errorf("threshold %d error: %w", i, err))
+				continue
+			}
+		}
+		t.Interval = config.Interval
+		t.MinSamples = config.MinSamples
+		t.RequireSamples = config.RequireSamples
+		t.tags = config.Tags
+		t.Direction = config.Direction
+		t.Epsilon = config.Epsilon
+		t.index = i
+		ts[i] = t
+	}
+	if err := joinThresholdErrors(errs); err != nil {
+		return Thresholds{}, err
+	}
+
+	return Thresholds{Runtime: rt, Thresholds: ts}, nil
+}
+
+func (ts *Thresholds) updateVM(sink Sink, t time.Duration) error {
+	ts.Runtime.Set("__sink__", sink)
+	values := sink.Format(t)
+	ts.samples = sampleCount(sink, values)
+	ts.Runtime.Set("__percentile__", newPercentileFunc(ts.Runtime, sink, values))
+	return ts.updateValues(values)
+}
+
+// newPercentileFunc returns the function used by p() to get the provided percentile, either
+// calculated by the sink, if it supports it, or looked up in the provided sink values, falling back
+// to calculating it on demand if the sink is a PercentileSink
+func newPercentileFunc(rt *goja.Runtime, sink Sink, values map[string]float64) func(float64) float64 {
+	return func(pct float64) float64 {
+		var v float64
+		if ps, ok := sink.(interface{ P(float64) float64 }); ok {
+			v = ps.P(pct / 100.0)
+		} else if found, ok := lookupPercentile(values, pct); ok {
+			v = found
+		} else if found, ok := percentileFromSink(sink, pct); ok {
+			v = found
+		} else {
+			panic(rt.NewGoError(fmt.Errorf("p(%v) isn't available for this metric", pct)))
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			panic(rt.NewGoError(fmt.Errorf("the value of \"p(%v)\" is %v and can't be compared", pct, v)))
+		}
+		return v
+	}
+}
+
+func percentileFromSink(sink Sink, pct float64) (float64, bool) {
+	ps, ok := sink.(PercentileSink)
+	if !ok {
+		return 0, false
+	}
+	return ps.Percentile(pct / 100.0)
+}
+
+var percentileKeyRegex = regexp.MustCompile(`^p\((.+)\)$`)
+
+// lookupPercentile finds the value of the provided percentile in formatted sink values, whose
+// percentile keys can be formatted differently, e.g. "p(95.0)" for p(95). A key formatted like the
+// percentile is preferred, and the first matching one in sorted order is used otherwise.
+func lookupPercentile(values map[string]float64, pct float64) (float64, bool) {
+	if v, ok := values[fmt.Sprintf("p(%v)", pct)]; ok {
+		return v, true
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := values[k]
+		matches := percentileKeyRegex.FindStringSubmatch(k)
+		if matches == nil {
+			continue
+		}
+		keyPct, err := strconv.ParseFloat(matches[1], 64)
+		if err == nil && math.Abs(keyPct-pct) <= 1e-9*math.Max(1, math.Abs(pct)) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// sampleCount returns the number of samples added to the provided sink, falling back to the count
+// value for sinks that don't keep track of it, or an invalid value if there's no count value either
+func sampleCount(sink Sink, values map[string]float64) null.Float {
+	switch s := sink.(type) {
+	case *CounterSink:
+		return null.FloatFrom(float64(s.Samples))
+	case *GaugeSink:
+		return null.FloatFrom(float64(s.Samples))
+	case *TrendSink:
+		return null.FloatFrom(float64(s.Count))
+	case *RateSink:
+		return null.FloatFrom(float64(s.Total))
+	default:
+		count, ok := values["count"]
+		return null.NewFloat(count, ok)
+	}
+}
+
+func (ts *Thresholds) updateValues(values map[string]float64) error {
+	// the values can be owned by the caller, e.g. of DummySink or RunWithValues, and reused by them
+	values = copyValues(values)
+	ts.previous, ts.current = ts.current, values
+	ts.Runtime.Set("change", newChangeFunc(ts.Runtime, ts.previous, ts.current))
+	return ts.setSinkValues(values)
+}
+
+// newChangeFunc returns the change(name) function available to the thresholds, returning the
+// relative change in percent of a sink value since the previous run, e.g. `change("p(95)") < 50`.
+// The change is 0 on the first run, as there is nothing to compare to yet, and infinite for any
+// change from 0.
+//
+// The sink values are cumulative for the whole test, not for the time since the previous run, so
+// the later in a test, the less the samples since the previous run move them. A sudden regression late
+// in a long test can barely change e.g. p(95), so change() only detects regressions big enough to
+// move the aggregate of all samples. Only the formatted sink values can be used, so percentiles
+// that aren't part of them, like p(99) of a trend, fail the evaluation even though p(99) works.
+func newChangeFunc(rt *goja.Runtime, previous, current map[string]float64) func(string) float64 {
+	return func(name string) float64 {
+		cur, ok := current[name]
+		if !ok {
+			panic(rt.NewGoError(fmt.Errorf("%s is not a value of the sink", name)))
+		}
+		prev, ok := previous[name]
+		if !ok {
+			return 0
+		}
+		if prev == cur {
+			return 0
+		}
+		return (cur - prev) / math.Abs(prev) * 100
+	}
+}
+
+// sinkValueAliases maps alternative names that can be used in thresholds to the canonical sink keys
+var sinkValueAliases = map[string]string{
+	"mean": "avg",
+}
+
+// sinkValueNames returns the names setSinkValues defines in the VM for the provided values
+func sinkValueNames(values map[string]float64) map[string]bool {
+	names := make(map[string]bool, len(values))
+	for k := range values {
+		names[k] = true
+	}
+	for alias, k := range sinkValueAliases {
+		if _, ok := values[k]; ok {
+			names[alias] = true
+		}
+	}
+	return names
+}
+
+func (ts *Thresholds) setSinkValues(values map[string]float64) error {
+	global := ts.Runtime.GlobalObject()
+	for k, v := range values {
+		if err := ts.setSinkValue(global, k, v); err != nil {
+			return err
+		}
+	}
+	for alias, k := range sinkValueAliases {
+		v, ok := values[k]
+		if _, exists := values[alias]; !ok || exists {
+			continue
+		}
+		if err := ts.setSinkValue(global, alias, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSinkValue exposes a single sink value to the thresholds VM. Non-finite values (e.g. the rate
+// or avg of a metric without any samples) are exposed through a getter that throws, as comparing
+// NaN or Inf against a threshold would otherwise silently pass or fail.
+func (ts *Thresholds) setSinkValue(global *goja.Object, k string, v float64) error {
+	if !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return global.DefineDataProperty(k, ts.Runtime.ToValue(v), goja.FLAG_TRUE, goja.FLAG_TRUE, goja.FLAG_TRUE)
+	}
+
+	getter := ts.Runtime.ToValue(func(goja.FunctionCall) goja.Value {
+		panic(ts.Runtime.NewGoError(fmt.Errorf("the value of %q is %v and can't be compared", k, v)))
+	})
+	return global.DefineAccessorProperty(k, getter, nil, goja.FLAG_TRUE, goja.FLAG_TRUE)
+}
+
+// intervalValues returns the change of every sink value since the previous run
+func (ts *Thresholds) intervalValues() map[string]float64 {
+	values := make(map[string]float64, len(ts.current))
+	for k, v := range ts.current {
+		values[k] = v - ts.previous[k]
+	}
+	return values
+}
+
+func (ts *Thresholds) runAll(ctx context.Context, t time.Duration) (bool, error) {
+	return ts.evaluate(ctx, t, true)
+}
+
+// evaluate runs all the thresholds with the current VM values. If taint is false, the state of the
+// thresholds, like LastFailed and Abort, isn't changed.
+func (ts *Thresholds) evaluate(ctx context.Context, t time.Duration, taint bool) (bool, error) {
+	succ := true
+	interval := false
+	// leave the cumulative values in the VM once done, regardless of the last threshold's mode
+	defer func() {
+		if interval {
+			_ = ts.setSinkValues(ts.current)
+		}
+	}()
+	for i, th := range ts.Thresholds {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		insufficientData := ts.samples.Valid && ts.samples.Float64 < float64(th.MinSamples)
+		if taint {
+			th.InsufficientData = insufficientData
+		}
+		if insufficientData {
+			if taint {
+				th.LastFailed, th.lastSlack = false, null.Float{}
+			}
+			continue
+		}
+		if th.Interval != interval {
+			values := ts.current
+			if th.Interval {
+				values = ts.intervalValues()
+			}
+			if err := ts.setSinkValues(values); err != nil {
+				return false, err
+			}
+			interval = th.Interval
+		}
+		var b bool
+		var err error
+		switch {
+		case th.RequireSamples && ts.samples.Valid && ts.samples.Float64 == 0:
+			if taint {
+				th.LastFailed, th.lastSlack = true, null.Float{}
+			}
+		case taint:
+			b, err = th.run()
+			th.lastSlack = null.Float{}
+			if err == nil && ts.detailed {
+				th.lastSlack = th.slack()
+			}
+		default:
+			b, err = th.runNoTaint()
+		}
+		if err != nil {
+			return false, fmt.Errorf("threshold %d run error: %w%s", i, err, ts.suggestion(err))
+		}
+		if !b {
+			succ = false
+
+			if !taint || ts.Abort || ts.ReportOnly || !th.AbortOnFail {
+				continue
+			}
+
+			ts.Abort = !th.AbortGracePeriod.Valid ||
+				th.AbortGracePeriod.Duration < types.Duration(t)
+		}
+	}
+	return succ, nil
+}
+
+var (
+	undefinedNameRegex  = regexp.MustCompile(`^(\S+) is not defined$`)
+	percentileTypoRegex = regexp.MustCompile(`^p\d+$`)
+)
+
+// suggestion returns a hint for a threshold run error caused by referencing a sink value that
+// doesn't exist, like "; did you mean 'avg'?" for averag, or an empty string
+func (ts *Thresholds) suggestion(err error) string {
+	var ex *goja.Exception
+	if !errors.As(err, &ex) {
+		return ""
+	}
+	obj, ok := ex.Value().(*goja.Object)
+	if !ok {
+		return ""
+	}
+	matches := undefinedNameRegex.FindStringSubmatch(obj.Get("message").String())
+	if matches == nil {
+		return ""
+	}
+	name := matches[1]
+	if percentileTypoRegex.MatchString(name) {
+		return fmt.Sprintf("; percentiles use the p(%s) syntax", name[1:])
+	}
+
+	best, bestDistance := "", 0
+	for method := range ts.current {
+		distance := levenshtein(name, method)
+		if best == "" || distance < bestDistance || (distance == bestDistance && method < best) {
+			best, bestDistance = method, distance
+		}
+	}
+	maxLen := len(name)
+	if len(best) > maxLen {
+		maxLen = len(best)
+	}
+	if best == "" || bestDistance > maxLen/2+1 {
+		return ""
+	}
+	return fmt.Sprintf("; did you mean '%s'?", best)
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// SetBaseline exposes the provided values, e.g. the sink values of a previous test run, as the
+// baseline object in the thresholds VM, so thresholds like `p(95) < baseline["p(95)"] * 1.1` can
+// be used for regression checks. Using a value the baseline doesn't have fails the evaluation.
+func (ts *Thresholds) SetBaseline(values map[string]float64) {
+	proto := ts.Runtime.NewObject().Prototype()
+	ts.Runtime.Set("baseline", ts.Runtime.NewDynamicObject(&baselineObject{
+		rt: ts.Runtime, proto: proto, values: copyValues(values),
+	}))
+}
+
+// baselineObject is the baseline object of the thresholds VM, which throws for missing values
+// instead of returning undefined, as comparing with it would silently fail
+type baselineObject struct {
+	rt     *goja.Runtime
+	proto  *goja.Object
+	values map[string]float64
+}
+
+func (b *baselineObject) Get(key string) goja.Value {
+	if v, ok := b.values[key]; ok {
+		return b.rt.ToValue(v)
+	}
+	if b.proto.Get(key) != nil {
+		return nil // inherited from Object.prototype, like toString
+	}
+	panic(b.rt.NewGoError(fmt.Errorf("%s is not a value of the baseline", key)))
+}
+
+func (b *baselineObject) Set(string, goja.Value) bool { return false }
+
+func (b *baselineObject) Has(key string) bool {
+	_, ok := b.values[key]
+	return ok
+}
+
+func (b *baselineObject) Delete(string) bool { return false }
+
+func (b *baselineObject) Keys() []string {
+	keys := make([]string, 0, len(b.values))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ThresholdEvaluator decides if a threshold passes, given the observed value on the left of its
+// comparison, the target value on the right and the operator, e.g. "<"
+type ThresholdEvaluator func(lhs, rhs float64, op string) (bool, error)
+
+// SetEvaluator registers a custom evaluator for the thresholds comparing the provided sink value,
+// like "avg" or "p(95)", which is used instead of their operator. Only thresholds that are a single
+// comparison with the sink value on the left, like `p(95) < 200`, use it. A nil evaluator restores
+// the default comparison.
+func (ts *Thresholds) SetEvaluator(method string, evaluator ThresholdEvaluator) {
+	for _, t := range ts.Thresholds {
+		if t.method != "" && t.method == method {
+			t.evaluator = evaluator
+		}
+	}
+}
+
+// MetricResolver returns the value of the provided aggregation method (e.g. "count" or "p(95)")
+// for the metric with the provided name and whether it could be resolved
+type MetricResolver func(metricName, method string) (float64, bool)
+
+// SetMetricResolver exposes the metric(name, method) function to the thresholds VM, so thresholds
+// can use values from other metrics, e.g. `metric("errors", "count") / metric("reqs", "count") < 0.01`.
+// Calling metric() with a name and method the resolver can't resolve fails the evaluation.
+func (ts *Thresholds) SetMetricResolver(resolver MetricResolver) {
+	ts.Runtime.Set("metric", func(metricName, method string) float64 {
+		v, ok := resolver(metricName, method)
+		if !ok {
+			panic(ts.Runtime.NewGoError(fmt.Errorf("can't resolve %s of metric %s", method, metricName)))
+		}
+		return v
+	})
+}
+
+// Run processes all the thresholds with the provided Sink at the provided time and returns if any
+// of them fails
+func (ts *Thresholds) Run(sink Sink, t time.Duration) (bool, error) {
+	return ts.RunContext(context.Background(), sink, t)
+}
+
+// RunContext is like Run, but stops processing the remaining thresholds and returns the context
+// error as soon as the provided context is done
+func (ts *Thresholds) RunContext(ctx context.Context, sink Sink, t time.Duration) (bool, error) {
+	if err := ts.updateVM(sink, t); err != nil {
+		return false, err
+	}
+	return ts.runAll(ctx, t)
+}
+
+// RunNoTaint is like Run, but only reports if all the thresholds pass, without changing their
+// LastFailed, the Abort flag or the sink values used by interval thresholds on the next Run
+func (ts *Thresholds) RunNoTaint(sink Sink, t time.Duration) (bool, error) {
+	previous, current, samples := ts.previous, ts.current, ts.samples
+	globals := []string{"__sink__", "__percentile__", "change"}
+	prevGlobals := make([]goja.Value, len(globals))
+	for i, name := range globals {
+		prevGlobals[i] = ts.Runtime.Get(name)
+	}
+	defer func() {
+		global := ts.Runtime.GlobalObject()
+		for i, name := range globals {
+			if prevGlobals[i] == nil {
+				_ = global.Delete(name)
+			} else {
+				ts.Runtime.Set(name, prevGlobals[i])
+			}
+		}
+		// the sink values only the speculative sink had would otherwise stay defined
+		kept := sinkValueNames(current)
+		for name := range sinkValueNames(ts.current) {
+			if !kept[name] {
+				_ = global.Delete(name)
+			}
+		}
+		ts.previous, ts.current, ts.samples = previous, current, samples
+		if current != nil {
+			_ = ts.setSinkValues(current)
+		}
+	}()
+
+	if err := ts.updateVM(sink, t); err != nil {
+		return false, err
+	}
+	return ts.evaluate(context.Background(), t, false)
+}
+
+// AggregationMethods returns the sorted and deduplicated sink values referenced by the thresholds,
+// e.g. "avg" or "p(95)", using their canonical keys, so mean is returned as "avg". Builtin JS
+// globals and the threshold helpers like approx() aren't included.
+func (ts *Thresholds) AggregationMethods() []string {
+	methods := make(map[string]struct{})
+	for _, t := range ts.Thresholds {
+		t.aggregationMethods(methods)
+	}
+
+	result := make([]string, 0, len(methods))
+	for method := range methods {
+		result = append(result, method)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// aggregationMethods adds the canonical keys of the sink values referenced by the threshold to
+// methods, e.g. avg for mean
+func (t Threshold) aggregationMethods(methods map[string]struct{}) {
+	var visit func(node ast.Node) bool
+	visit = func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.Identifier:
+			name := n.Name.String()
+			if builtinNames[name] {
+				return true
+			}
+			if alias, ok := sinkValueAliases[name]; ok {
+				name = alias
+			}
+			methods[name] = struct{}{}
+		case *ast.CallExpression:
+			callee, ok := n.Callee.(*ast.Identifier)
+			if !ok {
+				return true
+			}
+			if pcts, ok := percentileArguments(callee, n.ArgumentList); ok {
+				for _, pct := range pcts {
+					methods[fmt.Sprintf("p(%v)", pct)] = struct{}{}
+				}
+				return false
+			}
+			walkAST(reflect.ValueOf(n.ArgumentList), visit)
+			return false
+		}
+		return true
+	}
+
+	// the source has already been successfully compiled, so it can't fail parsing here
+	program, _ := parser.ParseFile(nil, "", t.Source, 0)
+	walkAST(reflect.ValueOf(program), visit)
+}
+
+// percentileArgument returns the percentile passed to a p() call with a single number literal
+func percentileArgument(callee *ast.Identifier, args []ast.Expression) (interface{}, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	pcts, ok := percentileArguments(callee, args)
+	if !ok {
+		return nil, false
+	}
+	return pcts[0], true
+}
+
+// percentileArguments returns the percentiles passed to a p() call with only number literals
+func percentileArguments(callee *ast.Identifier, args []ast.Expression) ([]interface{}, bool) {
+	if callee.Name != "p" || len(args) == 0 {
+		return nil, false
+	}
+	pcts := make([]interface{}, len(args))
+	for i, arg := range args {
+		lit, ok := arg.(*ast.NumberLiteral)
+		if !ok {
+			return nil, false
+		}
+		pcts[i] = lit.Value
+	}
+	return pcts, true
+}
+
+var astPkgPath = reflect.TypeOf(ast.Identifier{}).PkgPath()
+
+// walkAST calls visit for every node in the provided goja AST value, descending into the children
+// of a node only if visit returns true for it
+func walkAST(v reflect.Value, visit func(ast.Node) bool) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkAST(v.Elem(), visit)
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if node, ok := v.Interface().(ast.Node); ok && !visit(node) {
+			return
+		}
+		walkAST(v.Elem(), visit)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkAST(v.Index(i), visit)
+		}
+	case reflect.Struct:
+		if v.Type().PkgPath() != astPkgPath {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { // only exported fields
+				walkAST(v.Field(i), visit)
+			}
+		}
+	}
+}
+
+// LastSinked returns a copy of the sink values the thresholds were last run against.
+func (ts *Thresholds) LastSinked() map[string]float64 {
+	values := copyValues(ts.current)
+	if values == nil {
+		values = map[string]float64{}
+	}
+	return values
+}
+
+// ThresholdsState is the evaluation state of Thresholds, as captured by Snapshot
+type ThresholdsState struct {
+	// LastFailed has the LastFailed value of every threshold, in the same order
+	LastFailed []bool
+	Abort      bool
+}
+
+// Snapshot returns the current LastFailed values of the thresholds and the Abort flag
+func (ts *Thresholds) Snapshot() ThresholdsState {
+	state := ThresholdsState{LastFailed: make([]bool, len(ts.Thresholds)), Abort: ts.Abort}
+	for i, t := range ts.Thresholds {
+		state.LastFailed[i] = t.LastFailed
+	}
+	return state
+}
+
+// Restore sets the LastFailed values of the thresholds and the Abort flag to the ones of the provided
+// snapshot. Thresholds that weren't part of the snapshot are left unchanged.
+func (ts *Thresholds) Restore(state ThresholdsState) {
+	for i, t := range ts.Thresholds {
+		if i < len(state.LastFailed) {
+			t.LastFailed = state.LastFailed[i]
+		}
+	}
+	ts.Abort = state.Abort
+}
+
+// RunWithValues is like Run, but uses the provided already formatted sink values instead of a Sink.
+// Percentiles used with p() are looked up in them.
+func (ts *Thresholds) RunWithValues(values map[string]float64, t time.Duration) (bool, error) {
+	ts.Runtime.Set("__sink__", goja.Undefined())
+	ts.samples = sampleCount(nil, values)
+	ts.Runtime.Set("__percentile__", newPercentileFunc(ts.Runtime, nil, values))
+	if err := ts.updateValues(values); err != nil {
+		return false, err
+	}
+	return ts.runAll(context.Background(), t)
+}
+
+// ThresholdResult is the detailed outcome of the last run of a single threshold
+type ThresholdResult struct {
+	Source string
+	Passed bool
+	// Slack is the signed difference between the observed and the target value, e.g. -20 for
+	// `p(95) < 200` or `200 > p(95)` with a p(95) of 180. It's only valid for thresholds that are a
+	// single comparison with a sink value on one side.
+	Slack null.Float
+}
+
+// RunDetailed is like Run, but returns the detailed outcome of every threshold
+func (ts *Thresholds) RunDetailed(sink Sink, t time.Duration) ([]ThresholdResult, error) {
+	ts.detailed = true
+	_, err := ts.Run(sink, t)
+	ts.detailed = false
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ThresholdResult, len(ts.Thresholds))
+	for i, th := range ts.Thresholds {
+		results[i] = ThresholdResult{Source: th.Source, Passed: !th.LastFailed, Slack: th.lastSlack}
+	}
+	return results, nil
+}
+
+// FormatResult returns a human readable representation of the provided value of an aggregation
+// method, e.g. for reporting detailed threshold results. The values of trend aggregations like avg
+// and p(95) are assumed to be in milliseconds and are formatted as durations, while all others,
+// like rate and count, are formatted as plain numbers.
+func FormatResult(method string, value float64) string {
+	if !isTrendMethod(method) || math.IsNaN(value) || math.IsInf(value, 0) {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return time.Duration(value * float64(time.Millisecond)).Round(time.Microsecond).String()
+}
+
+func isTrendMethod(method string) bool {
+	switch method {
+	case "min", "max", "avg", "mean", "med":
+		return true
+	default:
+		return strings.HasPrefix(method, "p(")
+	}
+}
+
+// ThresholdNode is a node of the parse tree of a threshold source, annotated with its position.
+type ThresholdNode struct {
+	// Kind is one of "comparison", "method", "operator", "value" or "expression"
+	Kind string
+	// Text is the part of the source the node spans
+	Text string
+	// Start and End are the offsets of the node in the source, with End being exclusive
+	Start, End int
+	Children   []*ThresholdNode
+}
+
+// ParseThresholdAST returns the position annotated parse tree of the provided threshold source.
+// A single comparison like `p(95) < 200` is split into its method, operator and value nodes, while
+// any other source is returned as a single expression node, which is empty for sources without any
+// statements, e.g. only comments.
+func ParseThresholdAST(src string) (*ThresholdNode, error) {
+	program, err := parser.ParseFile(nil, "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	newNode := func(kind string, start, end int) *ThresholdNode {
+		return &ThresholdNode{Kind: kind, Text: src[start:end], Start: start, End: end}
+	}
+	if len(program.Body) == 0 {
+		return newNode("expression", 0, 0), nil
+	}
+
+	expr := comparisonExpression(program)
+	if expr == nil {
+		start, end := offset(program.Idx0()), offset(program.Idx1())
+		return newNode("expression", start, end), nil
+	}
+
+	left, right := expr.Left, expr.Right
+	leftKind, rightKind := "expression", "expression"
+	switch l := left.(type) {
+	case *ast.Identifier:
+		leftKind = "method"
+	case *ast.CallExpression:
+		if callee, ok := l.Callee.(*ast.Identifier); ok {
+			if _, ok := percentileArgument(callee, l.ArgumentList); ok {
+				leftKind = "method"
+			}
+		}
+	}
+	if _, ok := right.(*ast.NumberLiteral); ok {
+		rightKind = "value"
+	}
+
+	leftEnd, rightStart := offset(left.Idx1()), offset(right.Idx0())
+	operator := expr.Operator.String()
+	operatorStart := leftEnd + operatorOffset(src[leftEnd:rightStart], operator)
+
+	root := newNode("comparison", offset(left.Idx0()), offset(right.Idx1()))
+	root.Children = []*ThresholdNode{
+		newNode(leftKind, offset(left.Idx0()), leftEnd),
+		newNode("operator", operatorStart, operatorStart+len(operator)),
+		newNode(rightKind, rightStart, offset(right.Idx1())),
+	}
+	return root, nil
+}
+
+// operatorOffset returns the offset of the provided operator in the source between the two sides of
+// a comparison, which can also contain whitespace, parentheses and comments, skipping the latter
+func operatorOffset(gap, operator string) int {
+	for i := 0; i < len(gap); i++ {
+		switch {
+		case strings.HasPrefix(gap[i:], "/*"):
+			end := strings.Index(gap[i+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			i += 2 + end + 1
+		case strings.HasPrefix(gap[i:], "//"):
+			end := strings.IndexAny(gap[i:], "\n\r\u2028\u2029")
+			if end < 0 {
+				return -1
+			}
+			i += end
+		case strings.HasPrefix(gap[i:], operator):
+			return i
+		}
+	}
+	return -1
+}
+
+// GroupAbortPolicy decides when the failed thresholds of a ThresholdGroup abort the test.
+type GroupAbortPolicy int
+
+// Possible values for GroupAbortPolicy.
+const (
+	AbortIfAnyFails = GroupAbortPolicy(iota) // Any threshold with AbortOnFail aborts, as with Thresholds
+	AbortIfAllFail                           // Only the failure of every threshold in the group aborts
+)
+
+// ThresholdGroup is a named group of thresholds with a group level abort policy
+type ThresholdGroup struct {
+	Name        string
+	Thresholds  Thresholds
+	AbortPolicy GroupAbortPolicy
+}
+
+// Run processes all the thresholds of the group like Thresholds.Run and then applies the abort
+// policy, whose result is available in Thresholds.Abort. With AbortIfAllFail, the AbortOnFail and
+// AbortGracePeriod of the individual thresholds are ignored.
+func (g *ThresholdGroup) Run(sink Sink, t time.Duration) (bool, error) {
+	if g.AbortPolicy == AbortIfAnyFails {
+		return g.Thresholds.Run(sink, t)
+	}
+
+	reportOnly := g.Thresholds.ReportOnly
+	g.Thresholds.ReportOnly = true
+	succ, err := g.Thresholds.Run(sink, t)
+	g.Thresholds.ReportOnly = reportOnly
+	if err != nil || reportOnly || len(g.Thresholds.Thresholds) == 0 {
+		return succ, err
+	}
+
+	for _, th := range g.Thresholds.Thresholds {
+		if !th.LastFailed {
+			return succ, nil
+		}
+	}
+	g.Thresholds.Abort = true
+	return succ, nil
+}
+
+// ThresholdsByMetric holds the Thresholds of multiple metrics, keyed by the metric name
+type ThresholdsByMetric map[string]Thresholds
+
+// RunBatch runs the Thresholds of every metric, in order of their names, against the Sink of the same
+// name and returns if they passed for each metric. Processing stops at the first metric whose failed
+// thresholds abort the test in this call, so metrics after it won't be present in the result.
+// Metrics that had already aborted the test in an earlier run don't stop it.
+func (tbm ThresholdsByMetric) RunBatch(sinks map[string]Sink, t time.Duration) (map[string]bool, error) {
+	names := make([]string, 0, len(tbm))
+	for name := range tbm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make(map[string]bool, len(tbm))
+	for _, name := range names {
+		sink, ok := sinks[name]
+		if !ok {
+			return results, fmt.Errorf("no sink for metric %s", name)
+		}
+		ts := tbm[name]
+		wasAborted := ts.Abort
+		succ, err := ts.Run(sink, t)
+		tbm[name] = ts
+		if err != nil {
+			return results, fmt.Errorf("metric %s: %w", name, err)
+		}
+		results[name] = succ
+		if !wasAborted && ts.Abort {
+			break
+		}
+	}
+	return results, nil
+}
+
+// UnmarshalJSON is implementation of json.Unmarshaler
+func (ts *Thresholds) UnmarshalJSON(data []byte) error {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+	configs := make([]thresholdConfig, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &configs[i]); err != nil {
+			return err
+		}
+	}
+	newts, err := newThresholdsWithConfig(configs)
+	if err != nil {
+		return err
+	}
+	for i, raw := range raws {
+		if !hasUnknownFields(raw) {
+			continue
+		}
+		compacted := &bytes.Buffer{}
+		if err := json.Compact(compacted, raw); err != nil {
+			return err
+		}
+		newts.Thresholds[i].rawConfig = compacted.Bytes()
+	}
+	*ts = newts
+	return nil
+}
+
+// MarshalJSON is implementation of json.Marshaler
+func (ts Thresholds) MarshalJSON() ([]byte, error) {
+	configs := make([]interface{}, len(ts.Thresholds))
+	for i, t := range ts.Thresholds {
+		config := thresholdConfig{
+			Threshold:        t.Source,
+			AbortOnFail:      t.AbortOnFail,
+			AbortGracePeriod: t.AbortGracePeriod,
+			Interval:         t.Interval,
+			MinSamples:       t.MinSamples,
+			RequireSamples:   t.RequireSamples,
+			Tags:             t.tags,
+			Direction:        t.Direction,
+			Epsilon:          t.Epsilon,
+		}
+		configs[i] = config
+
+		// the original JSON is only emitted if none of the known fields were changed since
+		var rawConfig thresholdConfig
+		if t.rawConfig != nil && json.Unmarshal(t.rawConfig, &rawConfig) == nil &&
+			reflect.DeepEqual(rawConfig, config) {
+			configs[i] = t.rawConfig
+		}
+	}
+
+	return MarshalJSONWithoutHTMLEscape(configs)
+}
+
+type thresholdResult struct {
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	LastFailed  bool   `json:"lastFailed"`
+	AbortOnFail bool   `json:"abortOnFail"`
+}
+
+// MarshalResults returns the JSON representation of the outcome of the last run of every
+// threshold of the metric with the provided name, i.e. the metric name, the threshold source,
+// whether it failed and whether it's configured to abort the test when it fails.
+func (ts Thresholds) MarshalResults(name string) ([]byte, error) {
+	results := make([]thresholdResult, len(ts.Thresholds))
+	for i, t := range ts.Thresholds {
+		results[i].Name = name
+		results[i].Source = t.Source
+		results[i].LastFailed = t.LastFailed
+		results[i].AbortOnFail = t.AbortOnFail
+	}
+
+	return MarshalJSONWithoutHTMLEscape(results)
+}
+
+// MarshalJSONWithoutHTMLEscape marshals t to JSON without escaping characters
+// for safe use in HTML.
+func MarshalJSONWithoutHTMLEscape(t interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := EncodeJSONWithoutHTMLEscape(buffer, t)
+	return buffer.Bytes(), err
+}
+
+// EncodeJSONWithoutHTMLEscape writes t as JSON to w without escaping characters
+// for safe use in HTML.
+func EncodeJSONWithoutHTMLEscape(w io.Writer, t interface{}) error {
+	encoder := json.NewEncoder(trimNewlineWriter{w})
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(t)
+}
+
+// trimNewlineWriter removes the newline appended by Encode() :-/
+// See https://github.com/golang/go/issues/37083
+type trimNewlineWriter struct {
+	io.Writer
+}
+
+func (w trimNewlineWriter) Write(p []byte) (int, error) {
+	// Encode() writes the whole encoded value, including the newline, with a single Write()
+	n := len(p)
+	if n == 0 || p[n-1] != '\n' {
+		return w.Writer.Write(p)
+	}
+	if _, err := w.Writer.Write(p[:n-1]); err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 var _ json.Unmarshaler = &Thresholds{}
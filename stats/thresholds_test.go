@@ -21,12 +21,19 @@
 package stats
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"testing"
 	"time"
 
 	"github.com/dop251/goja"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/guregu/null.v3"
 
 	"go.k6.io/k6/lib/types"
 )
@@ -87,6 +94,39 @@ func TestThresholdRun(t *testing.T) {
 	})
 }
 
+func TestThresholdEvaluate(t *testing.T) {
+	testdata := map[string]bool{
+		"avg<200":   false,
+		"avg<=200":  true,
+		"avg>200":   false,
+		"avg>=200":  true,
+		"avg==200":  true,
+		"avg===200": true,
+		"avg!=200":  false,
+		"avg!==200": false,
+		"p(95)<300": true,
+		"rate<0.01": false,
+	}
+	for src, expected := range testdata {
+		src, expected := src, expected
+		t.Run(src, func(t *testing.T) {
+			th, err := newThreshold(src, goja.New(), false, types.NullDuration{})
+			assert.NoError(t, err)
+			b, err := th.Evaluate(200)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, b)
+			assert.False(t, th.LastFailed)
+		})
+	}
+
+	t.Run("NaN", func(t *testing.T) {
+		th, err := newThreshold("avg<200", goja.New(), false, types.NullDuration{})
+		assert.NoError(t, err)
+		_, err = th.Evaluate(math.NaN())
+		assert.Error(t, err)
+	})
+}
+
 func TestNewThresholds(t *testing.T) {
 	t.Run("empty", func(t *testing.T) {
 		ts, err := NewThresholds([]string{})
@@ -97,127 +137,1558 @@ func TestNewThresholds(t *testing.T) {
 		sources := []string{`1+1==2`, `1+1==4`}
 		ts, err := NewThresholds(sources)
 		assert.NoError(t, err)
-		assert.Len(t, ts.Thresholds, 2)
-		for i, th := range ts.Thresholds {
-			assert.Equal(t, sources[i], th.Source)
-			assert.False(t, th.LastFailed)
-			assert.False(t, th.AbortOnFail)
-			assert.NotNil(t, th.pgm)
-			assert.Equal(t, ts.Runtime, th.rt)
-		}
+		assert.Len(t, ts.Thresholds, 2)
+		for i, th := range ts.Thresholds {
+			assert.Equal(t, sources[i], th.Source)
+			assert.False(t, th.LastFailed)
+			assert.False(t, th.AbortOnFail)
+			assert.NotNil(t, th.pgm)
+			assert.Equal(t, ts.Runtime, th.rt)
+		}
+	})
+}
+
+func TestNewThresholdsErrors(t *testing.T) {
+	t.Run("one", func(t *testing.T) {
+		_, err := NewThresholds([]string{`1+1==2`, `1+1=`})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "threshold 1 error")
+	})
+	t.Run("trailing garbage", func(t *testing.T) {
+		for _, src := range []string{`rate<0.01xyz`, `rate<0.01 xyz`, `rate<0.01)`} {
+			_, err := NewThresholds([]string{src})
+			assert.Error(t, err, src)
+		}
+	})
+	t.Run("two", func(t *testing.T) {
+		_, err := NewThresholds([]string{`1+1=`, `1+1==2`, `rate<`})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "2 invalid thresholds")
+		assert.Contains(t, err.Error(), "threshold 0 error")
+		assert.NotContains(t, err.Error(), "threshold 1 error")
+		assert.Contains(t, err.Error(), "threshold 2 error")
+	})
+}
+
+func TestValidateThresholdSources(t *testing.T) {
+	assert.Empty(t, ValidateThresholdSources(nil))
+
+	errs := ValidateThresholdSources([]string{"rate<0.01", "rate<", "p(95)<200", "1+1="})
+	assert.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+	assert.Contains(t, errs[1].Error(), "threshold 1 error")
+	assert.NoError(t, errs[2])
+	assert.Error(t, errs[3])
+
+	sources := []string{"rate<1/0", "p(90,95)+1<3", "p(90,x)<3"}
+	for i, err := range ValidateThresholdSources(sources) {
+		assert.Error(t, err, sources[i])
+		_, newErr := NewThresholds([]string{sources[i]})
+		assert.Error(t, newErr, sources[i])
+	}
+}
+
+func TestThresholdsClone(t *testing.T) {
+	ts, err := NewThresholds([]string{"avg<100", "max<200"})
+	assert.NoError(t, err)
+	_, err = ts.Run(DummySink{"avg": 150, "max": 150}, time.Second)
+	assert.NoError(t, err)
+
+	clone := ts.Clone()
+	assert.NotSame(t, ts.Runtime, clone.Runtime)
+	assert.Equal(t, ts.LastSinked(), clone.LastSinked())
+	for i, th := range clone.Thresholds {
+		assert.NotSame(t, ts.Thresholds[i], th)
+		assert.Equal(t, ts.Thresholds[i].Source, th.Source)
+		assert.Equal(t, ts.Thresholds[i].LastFailed, th.LastFailed)
+		assert.Equal(t, clone.Runtime, th.rt)
+	}
+
+	clone.Thresholds[0].AbortOnFail = true
+	b, err := clone.Run(DummySink{"avg": 150, "max": 250}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, clone.Abort)
+	assert.True(t, clone.Thresholds[1].LastFailed)
+
+	assert.False(t, ts.Thresholds[0].AbortOnFail)
+	assert.False(t, ts.Abort)
+	assert.False(t, ts.Thresholds[1].LastFailed)
+	assert.Equal(t, 150.0, ts.LastSinked()["max"])
+	assert.Equal(t, 150.0, ts.Runtime.Get("max").ToFloat())
+}
+
+func TestThresholdsMerge(t *testing.T) {
+	base, err := newThresholdsWithConfig([]thresholdConfig{
+		{Threshold: "p(95)<200", AbortOnFail: true},
+		{Threshold: "avg<100"},
+		{Threshold: "max<500 || min>0"},
+	})
+	assert.NoError(t, err)
+	_, err = base.Run(DummySink{"p(95)": 300, "avg": 50, "max": 600, "min": 1}, time.Second)
+	assert.NoError(t, err)
+
+	t.Run("replace", func(t *testing.T) {
+		overrides, err := NewThresholds([]string{"p(95) < 300", "mean<150", "max<500 || min>0"})
+		assert.NoError(t, err)
+
+		merged := base.Merge(overrides)
+		sources := make([]string, len(merged.Thresholds))
+		for i, th := range merged.Thresholds {
+			sources[i] = th.Source
+			assert.Equal(t, i, th.Index())
+			assert.Equal(t, merged.Runtime, th.rt)
+			assert.False(t, th.LastFailed)
+		}
+		assert.Equal(t, []string{"p(95) < 300", "mean<150", "max<500 || min>0"}, sources)
+		assert.False(t, merged.Thresholds[0].AbortOnFail)
+		assert.NotSame(t, overrides.Thresholds[0], merged.Thresholds[0])
+
+		b, err := merged.Run(DummySink{"p(95)": 250, "avg": 120, "max": 100}, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+
+	t.Run("append", func(t *testing.T) {
+		extra, err := NewThresholds([]string{"p(95)>10", "p(99)<200", "max<500"})
+		assert.NoError(t, err)
+
+		merged := base.Merge(extra)
+		sources := make([]string, len(merged.Thresholds))
+		for i, th := range merged.Thresholds {
+			sources[i] = th.Source
+		}
+		assert.Equal(t, []string{"p(95)<200", "avg<100", "max<500 || min>0", "p(95)>10", "p(99)<200", "max<500"}, sources)
+		assert.True(t, merged.Thresholds[0].AbortOnFail)
+	})
+
+	// the inputs are unchanged
+	assert.Len(t, base.Thresholds, 3)
+	assert.Equal(t, "p(95)<200", base.Thresholds[0].Source)
+	assert.True(t, base.Thresholds[0].LastFailed)
+	assert.Equal(t, 1, base.Thresholds[1].Index())
+	assert.Equal(t, base.Runtime, base.Thresholds[0].rt)
+}
+
+func TestSupportedOperatorsAndAggregationMethods(t *testing.T) {
+	operators, methods := SupportedOperators(), SupportedAggregationMethods()
+	assert.NotEmpty(t, operators)
+	assert.NotEmpty(t, methods)
+
+	for _, op := range operators {
+		ts, err := NewThresholds([]string{"avg " + op + " 100"})
+		assert.NoError(t, err, op)
+		assert.NotNil(t, ts.Thresholds[0].observed, op)
+		assert.Equal(t, op, ts.Thresholds[0].operator)
+	}
+	ts, err := NewThresholds([]string{`"avg" in {}`})
+	assert.NoError(t, err)
+	assert.Nil(t, ts.Thresholds[0].observed)
+
+	for _, method := range methods {
+		_, warnings, err := NewThresholdsWithOptions([]string{method + "<1"}, ThresholdsOptions{SkipUnknownMethods: true})
+		assert.NoError(t, err, method)
+		assert.Empty(t, warnings, method)
+	}
+
+	// the returned lists are copies
+	operators[0], methods[0] = "", ""
+	assert.NotEqual(t, "", SupportedOperators()[0])
+	assert.NotEqual(t, "", SupportedAggregationMethods()[0])
+}
+
+func TestNewThresholdsForMetricType(t *testing.T) {
+	testdata := map[MetricType]struct {
+		valid, invalid []string
+	}{
+		Counter: {[]string{"count>0", "rate<100", "count>0 && rate<100"}, []string{"value>0", "avg<100", "p(95)<100"}},
+		Gauge:   {[]string{"value<100", `value<baseline["value"]`}, []string{"count>0", "rate<1"}},
+		Trend:   {[]string{"avg<100", "mean<100", "p(95)<200", "p(90,99)<300", "med<avg"}, []string{"count>0", "value<1"}},
+		Rate:    {[]string{"rate>0.99", `rate>metric("checks", "rate")`}, []string{"count>0", "p(95)<1"}},
+	}
+	for metricType, data := range testdata {
+		metricType, data := metricType, data
+		t.Run(metricType.String(), func(t *testing.T) {
+			ts, err := NewThresholdsForMetricType(data.valid, metricType)
+			assert.NoError(t, err)
+			assert.Len(t, ts.Thresholds, len(data.valid))
+
+			for _, src := range data.invalid {
+				_, err := NewThresholdsForMetricType([]string{src}, metricType)
+				if assert.Error(t, err, src) {
+					assert.Contains(t, err.Error(), "which "+metricType.String()+" metrics don't have")
+				}
+			}
+		})
+	}
+
+	_, err := NewThresholdsForMetricType([]string{"rate<1", "count>0 && avg<1", "p(95)<1"}, Rate)
+	assert.EqualError(t, err, "2 invalid thresholds: threshold 1 (count>0 && avg<1) uses avg, count, "+
+		"which rate metrics don't have; threshold 2 (p(95)<1) uses p(95), which rate metrics don't have")
+
+	_, err = NewThresholdsForMetricType([]string{"avg<"}, Trend)
+	assert.Error(t, err)
+	_, err = NewThresholdsForMetricType([]string{"avg<1"}, MetricType(42))
+	assert.Equal(t, ErrInvalidMetricType, err)
+}
+
+func TestNewThresholdsWithOptions(t *testing.T) {
+	sources := []string{"avg<100", "averag<100 && foo>1", "p(99.9)<300", "count>0"}
+
+	t.Run("default", func(t *testing.T) {
+		ts, warnings, err := NewThresholdsWithOptions(sources, ThresholdsOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, warnings)
+		assert.Len(t, ts.Thresholds, 4)
+	})
+
+	t.Run("skip unknown methods", func(t *testing.T) {
+		ts, warnings, err := NewThresholdsWithOptions(sources, ThresholdsOptions{SkipUnknownMethods: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"threshold 1 (averag<100 && foo>1) was skipped, as it references the unknown averag, foo",
+		}, warnings)
+		assert.Len(t, ts.Thresholds, 3)
+		for i, src := range []string{"avg<100", "p(99.9)<300", "count>0"} {
+			assert.Equal(t, src, ts.Thresholds[i].Source)
+		}
+		assert.Equal(t, 2, ts.Thresholds[1].Index())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := NewThresholdsWithOptions([]string{"avg<"}, ThresholdsOptions{SkipUnknownMethods: true})
+		assert.Error(t, err)
+	})
+}
+
+func TestNewThresholdsWithOptionsCommaDecimalSeparator(t *testing.T) {
+	sink := DummySink{"rate": 0.005, "p(90)": 150, "p(95)": 250}
+	sources := []string{"rate<0,01", "p(90, 95)<300", "p(90,95)<300"}
+
+	t.Run("dot", func(t *testing.T) {
+		_, _, err := NewThresholdsWithOptions(sources, ThresholdsOptions{})
+		assert.Error(t, err)
+
+		ts, _, err := NewThresholdsWithOptions(sources[1:], ThresholdsOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "p(90,95)<300", ts.Thresholds[1].Source)
+		b, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+
+	t.Run("comma", func(t *testing.T) {
+		_, _, err := NewThresholdsWithOptions(sources, ThresholdsOptions{CommaDecimalSeparator: true})
+		assert.EqualError(t, err, `threshold 2 error: "90,95" in the arguments of a call is ambiguous with `+
+			`a decimal comma, separate the arguments with a comma and a space`)
+
+		ts, _, err := NewThresholdsWithOptions(sources[:2], ThresholdsOptions{CommaDecimalSeparator: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "rate<0.01", ts.Thresholds[0].Source)
+		assert.Equal(t, "p(90, 95)<300", ts.Thresholds[1].Source)
+
+		b, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+
+		b, err = ts.Run(DummySink{"rate": 0.02, "p(90)": 150, "p(95)": 250}, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.True(t, ts.Thresholds[0].LastFailed)
+	})
+
+	t.Run("number literals", func(t *testing.T) {
+		for src, expected := range map[string]string{
+			`(0,5 + 0,25) > rate`:                 `(0.5 + 0.25) > rate`,
+			`p(95) < baseline["p(9,5)"] * 1,1`:    `p(95) < baseline["p(9,5)"] * 1.1`,
+			`rate < 0,01 /* 0,5 */ // 0,5`:        `rate < 0.01 /* 0,5 */ // 0,5`,
+			`approx(rate, 0, 1e-6) && x1,2 < 1,5`: `approx(rate, 0, 1e-6) && x1,2 < 1.5`,
+			`rate < 0.5,1`:                        `rate < 0.5,1`,
+			"rate < '\\',1' && rate < 2,5":        "rate < '\\',1' && rate < 2.5",
+		} {
+			normalized, err := normalizeDecimalCommas(src)
+			assert.NoError(t, err, src)
+			assert.Equal(t, expected, normalized, src)
+		}
+
+		for _, src := range []string{"p(90,95)<300", "approx(rate, 0,5)", "max(1,2) < avg"} {
+			_, err := normalizeDecimalCommas(src)
+			assert.Error(t, err, src)
+		}
+	})
+}
+
+func TestNewThresholdsWithOptionsContradictions(t *testing.T) {
+	opts := ThresholdsOptions{RejectContradictions: true}
+	t.Run("contradictory", func(t *testing.T) {
+		for _, sources := range [][]string{
+			{"p(95)<100", "p(95)>200"},
+			{"avg<=100", "100<avg"},
+			{"count==5", "count>5"},
+			{"avg<100", "mean>=100"},
+			{"value<-1", "value>-1"},
+		} {
+			_, _, err := NewThresholdsWithOptions(sources, opts)
+			if assert.Error(t, err, sources) {
+				assert.Contains(t, err.Error(), "contradict each other")
+			}
+		}
+
+		_, _, err := NewThresholdsWithOptions([]string{"p(95)<100", "avg<1", "p(95)>200", "avg>2"}, opts)
+		assert.EqualError(t, err,
+			"thresholds 0 (p(95)<100) and 2 (p(95)>200) contradict each other, as p(95) can't satisfy both; "+
+				"thresholds 1 (avg<1) and 3 (avg>2) contradict each other, as avg can't satisfy both")
+	})
+	t.Run("compatible", func(t *testing.T) {
+		for _, sources := range [][]string{
+			{"p(95)>100", "p(95)<200"},
+			{"avg<=100", "avg>=100"},
+			{"count==5", "count<6"},
+			{"p(95)<100", "p(99)>200"},
+			{"avg<100", "max>200"},
+			{"avg<100", "avg>200 || max>300"},
+			{"avg<100", "avg!=200"},
+		} {
+			ts, _, err := NewThresholdsWithOptions(sources, opts)
+			assert.NoError(t, err, sources)
+			assert.Len(t, ts.Thresholds, len(sources))
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		_, _, err := NewThresholdsWithOptions([]string{"p(95)<100", "p(95)>200"}, ThresholdsOptions{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestNewThresholdsWithConfig(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		ts, err := NewThresholds([]string{})
+		assert.NoError(t, err)
+		assert.Len(t, ts.Thresholds, 0)
+	})
+	t.Run("two", func(t *testing.T) {
+		configs := []thresholdConfig{
+			{`1+1==2`, false, types.NullDuration{}, false, 0, false, nil, UnknownDirection, 0},
+			{`1+1==4`, true, types.NullDuration{}, true, 10, true, map[string]string{"team": "payments"}, HigherIsBetter, 0.01},
+		}
+		ts, err := newThresholdsWithConfig(configs)
+		assert.NoError(t, err)
+		assert.Len(t, ts.Thresholds, 2)
+		for i, th := range ts.Thresholds {
+			assert.Equal(t, configs[i].Threshold, th.Source)
+			assert.False(t, th.LastFailed)
+			assert.Equal(t, configs[i].AbortOnFail, th.AbortOnFail)
+			assert.Equal(t, configs[i].Interval, th.Interval)
+			assert.Equal(t, configs[i].MinSamples, th.MinSamples)
+			assert.Equal(t, configs[i].RequireSamples, th.RequireSamples)
+			assert.Equal(t, configs[i].Tags, th.Tags())
+			assert.Equal(t, configs[i].Direction, th.Direction)
+			assert.Equal(t, configs[i].Epsilon, th.Epsilon)
+			assert.NotNil(t, th.pgm)
+			assert.Equal(t, ts.Runtime, th.rt)
+		}
+	})
+}
+
+func TestThresholdsUpdateVM(t *testing.T) {
+	ts, err := NewThresholds(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ts.updateVM(DummySink{"a": 1234.5}, 0))
+	assert.Equal(t, 1234.5, ts.Runtime.Get("a").ToFloat())
+}
+
+func TestThresholdsRunAll(t *testing.T) {
+	zero := types.NullDuration{}
+	oneSec := types.NullDurationFrom(time.Second)
+	twoSec := types.NullDurationFrom(2 * time.Second)
+	testdata := map[string]struct {
+		succ  bool
+		err   bool
+		abort bool
+		grace types.NullDuration
+		srcs  []string
+	}{
+		"one passing":                {true, false, false, zero, []string{`1+1==2`}},
+		"one failing":                {false, false, false, zero, []string{`1+1==4`}},
+		"two passing":                {true, false, false, zero, []string{`1+1==2`, `2+2==4`}},
+		"two failing":                {false, false, false, zero, []string{`1+1==4`, `2+2==2`}},
+		"two mixed":                  {false, false, false, zero, []string{`1+1==2`, `1+1==4`}},
+		"one erroring":               {false, true, false, zero, []string{`throw new Error('?!');`}},
+		"one aborting":               {false, false, true, zero, []string{`1+1==4`}},
+		"abort with grace period":    {false, false, true, oneSec, []string{`1+1==4`}},
+		"no abort with grace period": {false, false, true, twoSec, []string{`1+1==4`}},
+	}
+
+	for name, data := range testdata {
+		t.Run(name, func(t *testing.T) {
+			ts, err := NewThresholds(data.srcs)
+			assert.Nil(t, err)
+			ts.Thresholds[0].AbortOnFail = data.abort
+			ts.Thresholds[0].AbortGracePeriod = data.grace
+
+			runDuration := 1500 * time.Millisecond
+
+			assert.NoError(t, err)
+
+			b, err := ts.runAll(context.Background(), runDuration)
+
+			if data.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if data.succ {
+				assert.True(t, b)
+			} else {
+				assert.False(t, b)
+			}
+
+			if data.abort && data.grace.Duration < types.Duration(runDuration) {
+				assert.True(t, ts.Abort)
+			} else {
+				assert.False(t, ts.Abort)
+			}
+		})
+	}
+}
+
+func TestThresholdsRunAllReportOnly(t *testing.T) {
+	ts, err := NewThresholds([]string{`1+1==4`, `1+1==2`})
+	assert.NoError(t, err)
+	ts.Thresholds[0].AbortOnFail = true
+	ts.ReportOnly = true
+
+	b, err := ts.runAll(context.Background(), time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Abort)
+
+	ts.ReportOnly = false
+	b, err = ts.runAll(context.Background(), time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, ts.Abort)
+}
+
+func TestThresholdsRunAllGracePeriodBoundary(t *testing.T) {
+	grace := 1500 * time.Millisecond
+	testdata := map[time.Duration]bool{
+		grace - time.Millisecond: false,
+		grace:                    false,
+		grace + time.Millisecond: true,
+	}
+	for runDuration, abort := range testdata {
+		runDuration, abort := runDuration, abort
+		t.Run(runDuration.String(), func(t *testing.T) {
+			ts, err := NewThresholds([]string{`1+1==4`})
+			assert.NoError(t, err)
+			ts.Thresholds[0].AbortOnFail = true
+			ts.Thresholds[0].AbortGracePeriod = types.NullDurationFrom(grace)
+
+			b, err := ts.runAll(context.Background(), runDuration)
+			assert.NoError(t, err)
+			assert.False(t, b)
+			assert.Equal(t, abort, ts.Abort)
+		})
+	}
+}
+
+func TestThresholdsRun(t *testing.T) {
+	ts, err := NewThresholds([]string{"a>0"})
+	assert.NoError(t, err)
+
+	t.Run("error", func(t *testing.T) {
+		b, err := ts.Run(DummySink{}, 0)
+		assert.Error(t, err)
+		assert.False(t, b)
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		b, err := ts.Run(DummySink{"a": 1234.5}, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		b, err := ts.Run(DummySink{"a": 0}, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+	})
+
+	t.Run("NaN", func(t *testing.T) {
+		b, err := ts.Run(DummySink{"a": math.NaN()}, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `the value of "a" is NaN`)
+		assert.False(t, b)
+	})
+
+	t.Run("Inf", func(t *testing.T) {
+		b, err := ts.Run(DummySink{"a": math.Inf(1)}, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `the value of "a" is +Inf`)
+		assert.False(t, b)
+	})
+
+	t.Run("pass after NaN", func(t *testing.T) {
+		_, err := ts.Run(DummySink{"a": math.NaN()}, 0)
+		assert.Error(t, err)
+		b, err := ts.Run(DummySink{"a": 1234.5}, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+
+	t.Run("unreferenced NaN", func(t *testing.T) {
+		b, err := ts.Run(DummySink{"a": 1234.5, "b": math.NaN()}, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+}
+
+func TestThresholdsAggregationMethods(t *testing.T) {
+	ts, err := NewThresholds([]string{
+		"avg<200",
+		"p(95)<300 && p(99.0)<500",
+		`med<avg && max<baseline["max"] * 1.1`,
+		"approx(min, 0) || Math.abs(min) < 1",
+		`metric("errors", "count") / count < 0.01`,
+		"p(95)<p(99.9)",
+		"p(90,95)<400",
+		"mean<med",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"avg", "count", "max", "med", "min", "p(90)", "p(95)", "p(99)", "p(99.9)"}, ts.AggregationMethods())
+}
+
+func TestThresholdsMultiPercentile(t *testing.T) {
+	sink := &TrendSink{}
+	for i := 1; i <= 100; i++ {
+		sink.Add(Sample{Value: float64(i)})
+	}
+
+	for _, bound := range []string{"5", "80", "99", "99.5"} {
+		multi, err := NewThresholds([]string{"p(10,50,99) >= " + bound})
+		assert.NoError(t, err)
+		separate, err := NewThresholds([]string{"p(10) >= " + bound, "p(50) >= " + bound, "p(99) >= " + bound})
+		assert.NoError(t, err)
+
+		b, err := multi.Run(sink, 0)
+		assert.NoError(t, err)
+		expected, err := separate.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b, bound)
+	}
+
+	ts, err := NewThresholds([]string{"p(90,95,99)<300", "300 > p(90, 99.9)"})
+	assert.NoError(t, err)
+	b, err := ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+	assert.False(t, ts.Thresholds[0].slack().Valid)
+
+	sink.Add(Sample{Value: 1000})
+	sink.Add(Sample{Value: 1000})
+	b, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.True(t, ts.Thresholds[1].LastFailed)
+
+	data, err := MarshalJSONWithoutHTMLEscape(ts)
+	assert.NoError(t, err)
+	assert.Equal(t, `["p(90,95,99)<300","300 > p(90, 99.9)"]`, string(data))
+
+	for _, src := range []string{"p(90,95)<300 && avg<100", "p(90,95)<p(99,99.9)", "p(90,x)<300"} {
+		_, err := NewThresholds([]string{src})
+		assert.Error(t, err, src)
+	}
+}
+
+// percentileDummySink is a DummySink that calculates the percentiles missing from its values
+type percentileDummySink struct {
+	DummySink
+	calls []float64
+}
+
+func (d *percentileDummySink) Percentile(p float64) (float64, bool) {
+	d.calls = append(d.calls, p)
+	if p > 1 {
+		return 0, false
+	}
+	return p * 1000, true
+}
+
+func TestThresholdsRunPercentileSink(t *testing.T) {
+	sink := &percentileDummySink{DummySink: DummySink{"p(95)": 100}}
+	ts, err := NewThresholds([]string{"p(95) < 200", "p(97.5) > 900", "p(50) == 500"})
+	assert.NoError(t, err)
+
+	b, err := ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+	assert.Contains(t, sink.calls, 0.975)
+	assert.Contains(t, sink.calls, 0.5)
+	assert.NotContains(t, sink.calls, 0.95) // it's part of the values
+
+	ts, err = NewThresholds([]string{"p(150) < 200"})
+	assert.NoError(t, err)
+	_, err = ts.Run(sink, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "p(150) isn't available for this metric")
+}
+
+func TestThresholdsConstantArithmetic(t *testing.T) {
+	sink := DummySink{"rate": 0.0005, "count": 299, "avg": 0.9}
+	ts, err := NewThresholds([]string{"rate < 1/1000", "count < 60*5", "avg < (1+2)/3", "avg > -(1 - 2) * -1"})
+	assert.NoError(t, err)
+	b, err := ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	b, err = ts.Run(DummySink{"rate": 0.001, "count": 300, "avg": 1}, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	for _, th := range ts.Thresholds[:3] {
+		assert.True(t, th.LastFailed, th.Source)
+	}
+
+	for _, src := range []string{
+		"rate < 1/0", "rate < (1-1)/0", "count < -5/(2-2)", "count < 5%0", "1/0 > rate", "(1-1)/0 >= count",
+	} {
+		_, err := NewThresholds([]string{src})
+		assert.Error(t, err, src)
+		assert.Contains(t, err.Error(), "can't be compared")
+	}
+
+	// only constant arithmetic is checked, sink values can't be known beforehand
+	_, err = NewThresholds([]string{"rate < 1/count"})
+	assert.NoError(t, err)
+}
+
+func TestThresholdsRunDetailed(t *testing.T) {
+	ts, err := NewThresholds([]string{
+		"p(95) < 200", "avg > 150", "(max) >= 2 * 100", "min > 0 && max < 1000", "200 > p(95)", "1 + 1 == 2",
+	})
+	assert.NoError(t, err)
+	sink := &TrendSink{}
+	for _, v := range []float64{100, 180, 180} {
+		sink.Add(Sample{Value: v})
+	}
+
+	results, err := ts.RunDetailed(sink, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []ThresholdResult{
+		{Source: "p(95) < 200", Passed: true, Slack: null.FloatFrom(-20)},
+		{Source: "avg > 150", Passed: true, Slack: null.FloatFrom(sink.Avg - 150)},
+		{Source: "(max) >= 2 * 100", Passed: false, Slack: null.FloatFrom(-20)},
+		{Source: "min > 0 && max < 1000", Passed: true},
+		{Source: "200 > p(95)", Passed: true, Slack: null.FloatFrom(-20)},
+		{Source: "1 + 1 == 2", Passed: true},
+	}, results)
+
+	// the slack is only calculated for RunDetailed
+	_, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.False(t, ts.Thresholds[0].lastSlack.Valid)
+}
+
+func TestFormatResult(t *testing.T) {
+	testdata := []struct {
+		method   string
+		value    float64
+		expected string
+	}{
+		{"p(95)", 199.99999999, "200ms"},
+		{"avg", 1234.5678, "1.234568s"},
+		{"min", 0.25, "250µs"},
+		{"med", math.NaN(), "NaN"},
+		{"rate", 0.0042, "0.0042"},
+		{"count", 10, "10"},
+		{"value", 199.99999999, "199.99999999"},
+	}
+	for _, data := range testdata {
+		assert.Equal(t, data.expected, FormatResult(data.method, data.value), data.method)
+	}
+}
+
+func TestParseThresholdAST(t *testing.T) {
+	t.Run("comparison", func(t *testing.T) {
+		node, err := ParseThresholdAST("p(95) < 200")
+		assert.NoError(t, err)
+		assert.Equal(t, &ThresholdNode{
+			Kind: "comparison", Text: "p(95) < 200", Start: 0, End: 11,
+			Children: []*ThresholdNode{
+				{Kind: "method", Text: "p(95)", Start: 0, End: 5},
+				{Kind: "operator", Text: "<", Start: 6, End: 7},
+				{Kind: "value", Text: "200", Start: 8, End: 11},
+			},
+		}, node)
+	})
+
+	t.Run("comparison of expressions", func(t *testing.T) {
+		node, err := ParseThresholdAST("avg*2>=max")
+		assert.NoError(t, err)
+		assert.Equal(t, &ThresholdNode{
+			Kind: "comparison", Text: "avg*2>=max", Start: 0, End: 10,
+			Children: []*ThresholdNode{
+				{Kind: "expression", Text: "avg*2", Start: 0, End: 5},
+				{Kind: "operator", Text: ">=", Start: 5, End: 7},
+				{Kind: "expression", Text: "max", Start: 7, End: 10},
+			},
+		}, node)
+	})
+
+	t.Run("other", func(t *testing.T) {
+		node, err := ParseThresholdAST("min>0 && max<10")
+		assert.NoError(t, err)
+		assert.Equal(t, &ThresholdNode{Kind: "expression", Text: "min>0 && max<10", Start: 0, End: 15}, node)
+	})
+
+	t.Run("comments", func(t *testing.T) {
+		node, err := ParseThresholdAST("avg /*<=*/ <= // <\n 5")
+		assert.NoError(t, err)
+		assert.Equal(t, &ThresholdNode{
+			Kind: "comparison", Text: "avg /*<=*/ <= // <\n 5", Start: 0, End: 21,
+			Children: []*ThresholdNode{
+				{Kind: "method", Text: "avg", Start: 0, End: 3},
+				{Kind: "operator", Text: "<=", Start: 11, End: 13},
+				{Kind: "value", Text: "5", Start: 20, End: 21},
+			},
+		}, node)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		for _, src := range []string{"", "// x", " /* x */ "} {
+			node, err := ParseThresholdAST(src)
+			assert.NoError(t, err, src)
+			assert.Equal(t, &ThresholdNode{Kind: "expression"}, node, src)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseThresholdAST("p(95) <")
+		assert.Error(t, err)
+	})
+}
+
+func TestThresholdGroupRun(t *testing.T) {
+	newGroup := func(t *testing.T, policy GroupAbortPolicy) *ThresholdGroup {
+		ts, err := NewThresholds([]string{"avg<200", "max<300"})
+		assert.NoError(t, err)
+		ts.Thresholds[1].AbortOnFail = true
+		return &ThresholdGroup{Name: "latency", Thresholds: ts, AbortPolicy: policy}
+	}
+	oneFailing := DummySink{"avg": 100, "max": 400}
+	allFailing := DummySink{"avg": 300, "max": 400}
+
+	t.Run("any", func(t *testing.T) {
+		g := newGroup(t, AbortIfAnyFails)
+		b, err := g.Run(oneFailing, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.True(t, g.Thresholds.Abort)
+	})
+
+	t.Run("all with one failing", func(t *testing.T) {
+		g := newGroup(t, AbortIfAllFail)
+		b, err := g.Run(oneFailing, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, g.Thresholds.Abort)
+	})
+
+	t.Run("all with all failing", func(t *testing.T) {
+		g := newGroup(t, AbortIfAllFail)
+		b, err := g.Run(allFailing, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.True(t, g.Thresholds.Abort)
+		assert.False(t, g.Thresholds.ReportOnly)
+	})
+
+	t.Run("all in report only mode", func(t *testing.T) {
+		g := newGroup(t, AbortIfAllFail)
+		g.Thresholds.ReportOnly = true
+		b, err := g.Run(allFailing, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, g.Thresholds.Abort)
+		assert.True(t, g.Thresholds.ReportOnly)
+	})
+}
+
+func TestThresholdsByMetricRunBatch(t *testing.T) {
+	newThresholdsByMetric := func(t *testing.T) ThresholdsByMetric {
+		tbm := ThresholdsByMetric{}
+		for name, src := range map[string]string{"a": "value>0", "b": "value>10", "c": "value>0"} {
+			ts, err := NewThresholds([]string{src})
+			assert.NoError(t, err)
+			tbm[name] = ts
+		}
+		return tbm
+	}
+	sinks := map[string]Sink{"a": DummySink{"value": 1}, "b": DummySink{"value": 1}, "c": DummySink{"value": 1}}
+
+	t.Run("all", func(t *testing.T) {
+		tbm := newThresholdsByMetric(t)
+		results, err := tbm.RunBatch(sinks, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"a": true, "b": false, "c": true}, results)
+		assert.True(t, tbm["b"].Thresholds[0].LastFailed)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		tbm := newThresholdsByMetric(t)
+		tbm["b"].Thresholds[0].AbortOnFail = true
+		results, err := tbm.RunBatch(sinks, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"a": true, "b": false}, results)
+		assert.True(t, tbm["b"].Abort)
+	})
+
+	t.Run("aborted before", func(t *testing.T) {
+		tbm := newThresholdsByMetric(t)
+		a := tbm["a"]
+		a.Abort = true
+		tbm["a"] = a
+		results, err := tbm.RunBatch(sinks, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"a": true, "b": false, "c": true}, results)
+	})
+
+	t.Run("missing sink", func(t *testing.T) {
+		tbm := newThresholdsByMetric(t)
+		results, err := tbm.RunBatch(map[string]Sink{"a": DummySink{"value": 1}}, 0)
+		assert.EqualError(t, err, "no sink for metric b")
+		assert.Equal(t, map[string]bool{"a": true}, results)
+	})
+}
+
+func TestThresholdsRunInterval(t *testing.T) {
+	var ts Thresholds
+	assert.NoError(t, json.Unmarshal([]byte(`["count>12", {"threshold":"count>12","interval":true}, "count>12"]`), &ts))
+	assert.True(t, ts.Thresholds[1].Interval)
+
+	sink := &CounterSink{}
+	sink.Value = 20
+	b, err := ts.Run(sink, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	sink.Value = 25
+	b, err = ts.Run(sink, 2*time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.True(t, ts.Thresholds[1].LastFailed)
+	assert.False(t, ts.Thresholds[2].LastFailed)
+	assert.Equal(t, 25.0, ts.Runtime.Get("count").ToFloat())
+
+	data, err := MarshalJSONWithoutHTMLEscape(ts)
+	assert.NoError(t, err)
+	assert.Equal(t, `["count>12",{"threshold":"count>12","abortOnFail":false,"delayAbortEval":null,"interval":true},"count>12"]`, string(data))
+
+	t.Run("reused values", func(t *testing.T) {
+		ts, err := newThresholdsWithConfig([]thresholdConfig{
+			{Threshold: "count<5", Interval: true},
+			{Threshold: `change("count") < 50`},
+		})
+		assert.NoError(t, err)
+		values := map[string]float64{}
+		for i, count := range []float64{3, 20, 100} {
+			values["count"] = count
+			b, err := ts.RunWithValues(values, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, i == 0, b, "run %d with count=%v", i, count)
+		}
+
+		sink := DummySink{}
+		for i, count := range []float64{200, 400} {
+			sink["count"] = count
+			b, err := ts.Run(sink, 0)
+			assert.NoError(t, err)
+			assert.False(t, b, "run %d with count=%v", i, count)
+		}
+	})
+	t.Run("non-additive", func(t *testing.T) {
+		for _, src := range []string{"avg<60", "rate<0.1", "p(95)<60", "count>1 && avg<60"} {
+			var ts Thresholds
+			err := json.Unmarshal([]byte(`[{"threshold":"`+src+`","interval":true}]`), &ts)
+			assert.Error(t, err, src)
+			assert.Contains(t, err.Error(), "interval thresholds can only use count", src)
+		}
+
+		_, err := newThresholdsWithConfig([]thresholdConfig{{Threshold: "avg<60", Interval: true}})
+		assert.EqualError(t, err, "threshold 0 error: interval thresholds can only use count, not avg")
+	})
+}
+
+func TestThresholdsRunChange(t *testing.T) {
+	ts, err := NewThresholds([]string{`change("p(95)") < 50`})
+	assert.NoError(t, err)
+
+	for i, data := range []struct {
+		p95  float64
+		succ bool
+	}{
+		{100, true},
+		{120, true},
+		{200, false},
+		{210, true},
+		{0, true},
+		{10, false},
+	} {
+		b, err := ts.Run(DummySink{"p(95)": data.p95}, time.Duration(i)*10*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, data.succ, b, "run %d with p(95)=%v", i, data.p95)
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := ts.Run(DummySink{"avg": 1}, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "p(95) is not a value of the sink")
+	})
+}
+
+func TestThresholdsRunMinSamples(t *testing.T) {
+	var ts Thresholds
+	assert.NoError(t, json.Unmarshal([]byte(`[{"threshold":"avg<100","minSamples":3,"abortOnFail":true}, "max<200"]`), &ts))
+	assert.Equal(t, int64(3), ts.Thresholds[0].MinSamples)
+
+	sink := &TrendSink{}
+	sink.Add(Sample{Value: 150})
+	sink.Add(Sample{Value: 150})
+	b, err := ts.Run(sink, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, b)
+	assert.True(t, ts.Thresholds[0].InsufficientData)
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].InsufficientData)
+	assert.False(t, ts.Abort)
+
+	sink.Add(Sample{Value: 150})
+	b, err = ts.Run(sink, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.False(t, ts.Thresholds[0].InsufficientData)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.True(t, ts.Abort)
+
+	t.Run("values", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"avg<100"})
+		assert.NoError(t, err)
+		ts.Thresholds[0].MinSamples = 3
+		b, err := ts.RunWithValues(map[string]float64{"avg": 150, "count": 2}, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		assert.True(t, ts.Thresholds[0].InsufficientData)
+	})
+	t.Run("slack", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"avg<100"})
+		assert.NoError(t, err)
+		results, err := ts.RunDetailed(DummySink{"avg": 150, "count": 3}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, null.FloatFrom(50), results[0].Slack)
+
+		ts.Thresholds[0].MinSamples = 5
+		results, err = ts.RunDetailed(DummySink{"avg": 150, "count": 3}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []ThresholdResult{{Source: "avg<100", Passed: true}}, results)
+	})
+	t.Run("values without count", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"avg<100"})
+		assert.NoError(t, err)
+		ts.Thresholds[0].MinSamples = 3
+		b, err := ts.RunWithValues(map[string]float64{"avg": 150}, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, ts.Thresholds[0].InsufficientData)
+	})
+	t.Run("gauge", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"value<100"})
+		assert.NoError(t, err)
+		ts.Thresholds[0].MinSamples = 1
+		sink := &GaugeSink{}
+		b, err := ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		assert.True(t, ts.Thresholds[0].InsufficientData)
+
+		sink.Add(Sample{Value: 150})
+		b, err = ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, ts.Thresholds[0].InsufficientData)
+	})
+	t.Run("counter", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"count<1"})
+		assert.NoError(t, err)
+		ts.Thresholds[0].MinSamples = 3
+		sink := &CounterSink{}
+		sink.Add(Sample{Value: 5})
+		b, err := ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		assert.True(t, ts.Thresholds[0].InsufficientData)
+
+		sink.Add(Sample{Value: 5})
+		sink.Add(Sample{Value: 5})
+		b, err = ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, ts.Thresholds[0].InsufficientData)
+	})
+
+	data, err := MarshalJSONWithoutHTMLEscape(ts)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"threshold":"avg<100","abortOnFail":true,"delayAbortEval":null,"minSamples":3},"max<200"]`, string(data))
+}
+
+func TestThresholdsRunRequireSamples(t *testing.T) {
+	t.Run("fail", func(t *testing.T) {
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(`[{"threshold":"avg<100","requireSamples":true,"abortOnFail":true}]`), &ts))
+		assert.True(t, ts.Thresholds[0].RequireSamples)
+
+		sink := &TrendSink{}
+		b, err := ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.True(t, ts.Thresholds[0].LastFailed)
+		assert.False(t, ts.Thresholds[0].lastSlack.Valid)
+		assert.True(t, ts.Abort)
+
+		sink.Add(Sample{Value: 50})
+		b, err = ts.Run(sink, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		assert.False(t, ts.Thresholds[0].LastFailed)
+
+		data, err := MarshalJSONWithoutHTMLEscape(ts)
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"threshold":"avg<100","abortOnFail":true,"delayAbortEval":null,"requireSamples":true}]`, string(data))
+	})
+	t.Run("gauge and counter", func(t *testing.T) {
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(`[{"threshold":"value<100","requireSamples":true}]`), &ts))
+		gauge := &GaugeSink{}
+		b, err := ts.Run(gauge, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+
+		gauge.Add(Sample{Value: 50})
+		b, err = ts.Run(gauge, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+
+		assert.NoError(t, json.Unmarshal([]byte(`[{"threshold":"count>=0","requireSamples":true}]`), &ts))
+		counter := &CounterSink{}
+		b, err = ts.Run(counter, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+
+		counter.Add(Sample{Value: 0})
+		b, err = ts.Run(counter, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+	t.Run("skip", func(t *testing.T) {
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(`[{"threshold":"avg<100","minSamples":1}]`), &ts))
+
+		b, err := ts.Run(&TrendSink{}, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		assert.True(t, ts.Thresholds[0].InsufficientData)
+		assert.False(t, ts.Thresholds[0].LastFailed)
+	})
+	t.Run("default", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"avg<100"})
+		assert.NoError(t, err)
+		b, err := ts.Run(&TrendSink{}, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+}
+
+func TestThresholdsRunNoTaint(t *testing.T) {
+	ts, err := newThresholdsWithConfig([]thresholdConfig{
+		{Threshold: "avg<100", AbortOnFail: true},
+		{Threshold: "count<5", Interval: true},
+	})
+	assert.NoError(t, err)
+	b, err := ts.Run(DummySink{"avg": 50, "count": 3}, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	b, err = ts.RunNoTaint(DummySink{"avg": 150, "count": 10}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].LastFailed)
+	assert.False(t, ts.Abort)
+	assert.Equal(t, map[string]float64{"avg": 50, "count": 3}, ts.LastSinked())
+	assert.Equal(t, 50.0, ts.Runtime.Get("avg").ToFloat())
+
+	b, err = ts.Run(DummySink{"avg": 150, "count": 6}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].LastFailed)
+	assert.True(t, ts.Abort)
+
+	b, err = ts.RunNoTaint(DummySink{"avg": 50, "count": 7}, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, b)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.True(t, ts.Abort)
+
+	t.Run("VM", func(t *testing.T) {
+		ts, err := NewThresholds([]string{`change("count") < 50`})
+		assert.NoError(t, err)
+		_, err = ts.RunNoTaint(DummySink{"count": 1}, time.Second)
+		assert.NoError(t, err)
+		assert.Nil(t, ts.Runtime.Get("change"))
+		assert.Nil(t, ts.Runtime.Get("count"))
+
+		b, err := ts.Run(DummySink{"count": 100}, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, b)
+		b, err = ts.RunNoTaint(DummySink{"count": 10000, "rate": 2}, time.Second)
+		assert.NoError(t, err)
+		assert.False(t, b)
+
+		v, err := ts.Runtime.RunString(`change("count")`)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.0, v.ToFloat())
+		assert.Nil(t, ts.Runtime.Get("rate"))
+		assert.Equal(t, 100.0, ts.Runtime.Get("count").ToFloat())
+	})
+}
+
+func TestThresholdsSetEvaluator(t *testing.T) {
+	ts, err := NewThresholds([]string{"avg < 100", "mean <= 100", "p(95) < 100", "100 > avg", "avg < 100 && max > 0"})
+	assert.NoError(t, err)
+	sink := DummySink{"avg": 150, "p(95)": 150, "max": 200}
+
+	b, err := ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+
+	var ops []string
+	inverted := func(lhs, rhs float64, op string) (bool, error) {
+		ops = append(ops, op)
+		switch op {
+		case "<":
+			return lhs >= rhs, nil
+		case "<=":
+			return lhs > rhs, nil
+		default:
+			return false, fmt.Errorf("unsupported operator %s", op)
+		}
+	}
+	ts.SetEvaluator("avg", inverted)
+	_, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"<", "<="}, ops)
+	for i, failed := range []bool{false, false, true, true, true} {
+		assert.Equal(t, failed, ts.Thresholds[i].LastFailed, ts.Thresholds[i].Source)
+	}
+	b, err = ts.Thresholds[0].Evaluate(50)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	b, err = ts.Thresholds[0].Evaluate(150)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	ts.SetEvaluator("p(95)", func(lhs, rhs float64, op string) (bool, error) {
+		return false, errors.New("boom")
+	})
+	_, err = ts.Run(sink, 0)
+	assert.EqualError(t, err, "threshold 2 run error: boom")
+
+	ts.SetEvaluator("p(95)", nil)
+	ts.SetEvaluator("avg", nil)
+	b, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+}
+
+func TestThresholdsSnapshotRestore(t *testing.T) {
+	ts, err := newThresholdsWithConfig([]thresholdConfig{
+		{Threshold: "avg<100", AbortOnFail: true},
+		{Threshold: "max<200"},
+	})
+	assert.NoError(t, err)
+	b, err := ts.Run(DummySink{"avg": 150, "max": 150}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+
+	state := ts.Snapshot()
+	assert.Equal(t, ThresholdsState{LastFailed: []bool{true, false}, Abort: true}, state)
+
+	ts.Abort = false
+	b, err = ts.Run(DummySink{"avg": 50, "max": 250}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.True(t, ts.Thresholds[1].LastFailed)
+	assert.False(t, ts.Abort)
+	assert.Equal(t, []bool{true, false}, state.LastFailed) // the snapshot is a copy
+
+	ts.Restore(state)
+	assert.True(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].LastFailed)
+	assert.True(t, ts.Abort)
+
+	ts.Restore(ThresholdsState{LastFailed: []bool{false}})
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].LastFailed)
+	assert.False(t, ts.Abort)
+}
+
+func TestThresholdsRunContext(t *testing.T) {
+	ts, err := NewThresholds([]string{"cancel() || a>0", "a>1000"})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.Runtime.Set("cancel", cancel)
+
+	b, err := ts.RunContext(ctx, DummySink{"a": 1}, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, b)
+	assert.False(t, ts.Thresholds[0].LastFailed)
+	assert.False(t, ts.Thresholds[1].LastFailed, "second threshold shouldn't have been run")
+}
+
+func TestThresholdsRunLeadingBOM(t *testing.T) {
+	// U+FEFF is whitespace for the JS parser, so config pasted with a byte-order mark still works
+	ts, err := NewThresholds([]string{"\uFEFFrate<0.01", "\uFEFF \trate<0.01"})
+	assert.NoError(t, err)
+
+	b, err := ts.Run(DummySink{"rate": 0.001}, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	b, err = ts.Run(DummySink{"rate": 0.1}, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+}
+
+func TestThresholdsRunComments(t *testing.T) {
+	ts, err := NewThresholds([]string{
+		"rate<0.01 // keep the errors low",
+		"// a full line comment\nrate<0.01",
+		"rate /* inline */ < 0.01",
+		`metric("a//b", "rate") < 0.01 // the first // isn't a comment`,
+	})
+	assert.NoError(t, err)
+	ts.SetMetricResolver(func(metricName, method string) (float64, bool) {
+		return 0.001, metricName == "a//b"
+	})
+
+	b, err := ts.Run(DummySink{"rate": 0.001}, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	b, err = ts.Run(DummySink{"rate": 0.1}, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+	for i, th := range ts.Thresholds[:3] {
+		assert.True(t, th.LastFailed, i)
+	}
+	assert.False(t, ts.Thresholds[3].LastFailed)
+}
+
+func TestThresholdsRunAlias(t *testing.T) {
+	ts, err := NewThresholds([]string{"mean<100"})
+	assert.NoError(t, err)
+
+	b, err := ts.Run(DummySink{"avg": 50}, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	b, err = ts.Run(DummySink{"avg": 150}, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+
+	b, err = ts.Run(DummySink{"avg": 150, "mean": 50}, 0)
+	assert.NoError(t, err)
+	assert.True(t, b, "a sink value takes precedence over an alias")
+}
+
+func TestThresholdsBaseline(t *testing.T) {
+	ts, err := NewThresholds([]string{`p(95) < baseline["p(95)"] * 1.1`, `avg < baseline.avg`, "max < 300"})
+	assert.NoError(t, err)
+	sink := &TrendSink{}
+	for _, v := range []float64{100, 200, 250} {
+		sink.Add(Sample{Value: v})
+	}
+
+	t.Run("no baseline", func(t *testing.T) {
+		b, err := ts.Run(sink, 0)
+		assert.Error(t, err)
+		assert.False(t, b)
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		ts.SetBaseline(map[string]float64{"p(95)": 230, "avg": 190})
+		b, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		ts.SetBaseline(map[string]float64{"p(95)": 200, "avg": 190})
+		b, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.True(t, ts.Thresholds[0].LastFailed)
+		assert.False(t, ts.Thresholds[1].LastFailed)
+		assert.False(t, ts.Thresholds[2].LastFailed)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		ts.SetBaseline(map[string]float64{"avg": 190})
+		b, err := ts.Run(sink, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "p(95) is not a value of the baseline")
+		assert.False(t, b)
+	})
+
+	t.Run("inherited", func(t *testing.T) {
+		ts, err := NewThresholds([]string{`"p(95)" in baseline && baseline.hasOwnProperty("avg")`})
+		assert.NoError(t, err)
+		ts.SetBaseline(map[string]float64{"p(95)": 200, "avg": 190})
+		b, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		assert.True(t, b)
 	})
 }
 
-func TestNewThresholdsWithConfig(t *testing.T) {
-	t.Run("empty", func(t *testing.T) {
-		ts, err := NewThresholds([]string{})
+func TestThresholdsMetricResolver(t *testing.T) {
+	ts, err := NewThresholds([]string{`metric("errors", "count") / metric("reqs", "count") < 0.01`, "count > 0"})
+	assert.NoError(t, err)
+	sinks := map[string]Sink{
+		"errors": &CounterSink{Value: 5},
+		"reqs":   &CounterSink{Value: 1000},
+	}
+	ts.SetMetricResolver(func(metricName, method string) (float64, bool) {
+		sink, ok := sinks[metricName]
+		if !ok {
+			return 0, false
+		}
+		v, ok := sink.Format(0)[method]
+		return v, ok
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		b, err := ts.Run(sinks["reqs"], time.Second)
 		assert.NoError(t, err)
-		assert.Len(t, ts.Thresholds, 0)
+		assert.True(t, b)
 	})
-	t.Run("two", func(t *testing.T) {
-		configs := []thresholdConfig{
-			{`1+1==2`, false, types.NullDuration{}},
-			{`1+1==4`, true, types.NullDuration{}},
-		}
-		ts, err := newThresholdsWithConfig(configs)
+
+	t.Run("fail", func(t *testing.T) {
+		sinks["errors"] = &CounterSink{Value: 50}
+		b, err := ts.Run(sinks["reqs"], time.Second)
 		assert.NoError(t, err)
-		assert.Len(t, ts.Thresholds, 2)
-		for i, th := range ts.Thresholds {
-			assert.Equal(t, configs[i].Threshold, th.Source)
-			assert.False(t, th.LastFailed)
-			assert.Equal(t, configs[i].AbortOnFail, th.AbortOnFail)
-			assert.NotNil(t, th.pgm)
-			assert.Equal(t, ts.Runtime, th.rt)
-		}
+		assert.False(t, b)
+		assert.True(t, ts.Thresholds[0].LastFailed)
+		assert.False(t, ts.Thresholds[1].LastFailed)
 	})
-}
 
-func TestThresholdsUpdateVM(t *testing.T) {
-	ts, err := NewThresholds(nil)
-	assert.NoError(t, err)
-	assert.NoError(t, ts.updateVM(DummySink{"a": 1234.5}, 0))
-	assert.Equal(t, 1234.5, ts.Runtime.Get("a").ToFloat())
+	t.Run("unresolved", func(t *testing.T) {
+		delete(sinks, "errors")
+		b, err := ts.Run(sinks["reqs"], time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "can't resolve count of metric errors")
+		assert.False(t, b)
+	})
 }
 
-func TestThresholdsRunAll(t *testing.T) {
-	zero := types.NullDuration{}
-	oneSec := types.NullDurationFrom(time.Second)
-	twoSec := types.NullDurationFrom(2 * time.Second)
-	testdata := map[string]struct {
-		succ  bool
-		err   bool
-		abort bool
-		grace types.NullDuration
-		srcs  []string
+func TestThresholdsRunPercentileLookup(t *testing.T) {
+	testdata := []struct {
+		src  string
+		sink DummySink
 	}{
-		"one passing":                {true, false, false, zero, []string{`1+1==2`}},
-		"one failing":                {false, false, false, zero, []string{`1+1==4`}},
-		"two passing":                {true, false, false, zero, []string{`1+1==2`, `2+2==4`}},
-		"two failing":                {false, false, false, zero, []string{`1+1==4`, `2+2==2`}},
-		"two mixed":                  {false, false, false, zero, []string{`1+1==2`, `1+1==4`}},
-		"one erroring":               {false, true, false, zero, []string{`throw new Error('?!');`}},
-		"one aborting":               {false, false, true, zero, []string{`1+1==4`}},
-		"abort with grace period":    {false, false, true, oneSec, []string{`1+1==4`}},
-		"no abort with grace period": {false, false, true, twoSec, []string{`1+1==4`}},
+		{"p(95)==1", DummySink{"p(95)": 1}},
+		{"p(95)==1", DummySink{"p(95.0)": 1}},
+		{"p(95.0)==1", DummySink{"p(95)": 1}},
+		{"p(99.9)==1", DummySink{"p(99.90)": 1, "p(99)": 2}},
+		{"p(99.90)==1", DummySink{"p(99.9)": 1}},
+		{"p(95.5)==1", DummySink{"p(95.50)": 1, "p(95)": 2}},
+		{"p(95)==1", DummySink{"p(95)": 1, "p(95.0)": 2, "p(95.00)": 3}},
+		{"p(95.0)==1", DummySink{"p(95.00)": 2, "p(95)": 1, "p(95.0)": 3}},
+		{"p(95)==1", DummySink{"p(95.00)": 2, "p(95.0)": 1}},
+	}
+	for _, data := range testdata {
+		data := data
+		t.Run(fmt.Sprintf("%s %v", data.src, data.sink), func(t *testing.T) {
+			ts, err := NewThresholds([]string{data.src})
+			assert.NoError(t, err)
+			b, err := ts.Run(data.sink, 0)
+			assert.NoError(t, err)
+			assert.True(t, b)
+		})
 	}
 
-	for name, data := range testdata {
-		t.Run(name, func(t *testing.T) {
-			ts, err := NewThresholds(data.srcs)
-			assert.Nil(t, err)
-			ts.Thresholds[0].AbortOnFail = data.abort
-			ts.Thresholds[0].AbortGracePeriod = data.grace
+	t.Run("missing", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"p(95)<1"})
+		assert.NoError(t, err)
+		_, err = ts.Run(DummySink{"p(90)": 0, "p(95": 0}, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "p(95) isn't available for this metric")
+	})
 
-			runDuration := 1500 * time.Millisecond
+	t.Run("NaN", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"p(95)<1"})
+		assert.NoError(t, err)
+		_, err = ts.Run(DummySink{"p(95)": math.NaN()}, 0)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `the value of "p(95)" is NaN`)
+	})
+}
 
+func TestThresholdsApprox(t *testing.T) {
+	testdata := map[string]bool{
+		"avg==100":                   false,
+		"avg===100":                  false,
+		"approx(avg, 100)":           true,
+		"approx(avg, 100.001)":       false,
+		"approx(avg, 100.001, 1e-4)": true,
+		"approx(zero, 0)":            true,
+		"approx(zero, 1e-9)":         false,
+	}
+	sink := DummySink{"avg": 100.0000001, "zero": 0}
+	for src, expected := range testdata {
+		src, expected := src, expected
+		t.Run(src, func(t *testing.T) {
+			ts, err := NewThresholds([]string{src})
 			assert.NoError(t, err)
+			b, err := ts.Run(sink, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, b)
+		})
+	}
 
-			b, err := ts.runAll(runDuration)
-
-			if data.err {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
+	t.Run("epsilon", func(t *testing.T) {
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(`[
+			{"threshold":"avg==100","epsilon":1e-6},
+			{"threshold":"100==avg","epsilon":1e-6},
+			{"threshold":"avg===100","epsilon":1e-6},
+			{"threshold":"avg==100.001","epsilon":1e-6},
+			"avg==100"
+		]`), &ts))
+		assert.Equal(t, 1e-6, ts.Thresholds[0].Epsilon)
+		_, err := ts.Run(sink, 0)
+		assert.NoError(t, err)
+		for i, failed := range []bool{false, false, true, true, true} {
+			assert.Equal(t, failed, ts.Thresholds[i].LastFailed, ts.Thresholds[i].Source)
+		}
 
-			if data.succ {
-				assert.True(t, b)
-			} else {
-				assert.False(t, b)
-			}
+		data, err := MarshalJSONWithoutHTMLEscape(Thresholds{Thresholds: ts.Thresholds[:1]})
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"threshold":"avg==100","abortOnFail":false,"delayAbortEval":null,"epsilon":0.000001}]`, string(data))
 
-			if data.abort && data.grace.Duration < types.Duration(runDuration) {
-				assert.True(t, ts.Abort)
-			} else {
-				assert.False(t, ts.Abort)
-			}
-		})
-	}
+		assert.Error(t, json.Unmarshal([]byte(`[{"threshold":"avg==100","epsilon":-1}]`), &ts))
+	})
 }
 
-func TestThresholdsRun(t *testing.T) {
-	ts, err := NewThresholds([]string{"a>0"})
+func TestThresholdsRunWithValues(t *testing.T) {
+	ts, err := NewThresholds([]string{"avg<200", "max<300"})
 	assert.NoError(t, err)
 
-	t.Run("error", func(t *testing.T) {
-		b, err := ts.Run(DummySink{}, 0)
+	t.Run("missing", func(t *testing.T) {
+		b, err := ts.RunWithValues(map[string]float64{"avg": 100}, 0)
 		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "max is not defined")
 		assert.False(t, b)
 	})
 
 	t.Run("pass", func(t *testing.T) {
-		b, err := ts.Run(DummySink{"a": 1234.5}, 0)
+		b, err := ts.RunWithValues(map[string]float64{"avg": 100, "max": 250}, 0)
 		assert.NoError(t, err)
 		assert.True(t, b)
 	})
 
 	t.Run("fail", func(t *testing.T) {
-		b, err := ts.Run(DummySink{"a": 0}, 0)
+		b, err := ts.RunWithValues(map[string]float64{"avg": 100, "max": 350}, 0)
+		assert.NoError(t, err)
+		assert.False(t, b)
+		assert.False(t, ts.Thresholds[0].LastFailed)
+		assert.True(t, ts.Thresholds[1].LastFailed)
+	})
+
+	t.Run("percentile", func(t *testing.T) {
+		ts, err := NewThresholds([]string{"p(95)<200"})
+		assert.NoError(t, err)
+		b, err := ts.RunWithValues(map[string]float64{"p(95)": 100}, 0)
 		assert.NoError(t, err)
+		assert.True(t, b)
+
+		b, err = ts.RunWithValues(map[string]float64{"p(90)": 100}, 0)
+		assert.Error(t, err)
 		assert.False(t, b)
 	})
 }
 
+func TestThresholdsLastSinked(t *testing.T) {
+	ts, err := NewThresholds([]string{"avg<100"})
+	assert.NoError(t, err)
+	assert.Empty(t, ts.LastSinked())
+
+	sink := &TrendSink{}
+	sink.Add(Sample{Value: 50})
+	_, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+	sink.Add(Sample{Value: 150})
+	_, err = ts.Run(sink, 0)
+	assert.NoError(t, err)
+
+	sinked := ts.LastSinked()
+	assert.Equal(t, sink.Format(0), sinked)
+	assert.Equal(t, 100.0, sinked["avg"])
+
+	sinked["avg"] = 0
+	assert.Equal(t, 100.0, ts.LastSinked()["avg"], "the returned map should be a copy")
+}
+
+func TestThresholdsRunPercentile(t *testing.T) {
+	sink := &TrendSink{}
+	for i := 1; i <= 100; i++ {
+		sink.Add(Sample{Value: float64(i)})
+	}
+
+	// p() is evaluated from the source and not looked up as a sink key, so
+	// any spelling of the same percentile must produce the same value.
+	testdata := map[string]float64{
+		"p(50)":    sink.P(0.5),
+		"p(50.0)":  sink.P(0.5),
+		"p(99)":    sink.P(0.99),
+		"p(99.0)":  sink.P(0.99),
+		"p(99.00)": sink.P(0.99),
+		"p(95)":    sink.P(0.95),
+		"p(95.5)":  sink.P(0.955),
+		"p(95.50)": sink.P(0.955),
+		"p(100)":   100,
+	}
+	for src, expected := range testdata {
+		src, expected := src, expected
+		t.Run(src, func(t *testing.T) {
+			ts, err := NewThresholds([]string{fmt.Sprintf("%s==%v", src, expected)})
+			assert.NoError(t, err)
+			b, err := ts.Run(sink, 0)
+			assert.NoError(t, err)
+			assert.True(t, b)
+		})
+	}
+}
+
 func TestThresholdsJSON(t *testing.T) {
 	var testdata = []struct {
 		JSON        string
@@ -298,6 +1769,7 @@ func TestThresholdsJSON(t *testing.T) {
 			assert.Equal(t, len(data.srcs), len(ts.Thresholds))
 			for i, src := range data.srcs {
 				assert.Equal(t, src, ts.Thresholds[i].Source)
+				assert.Equal(t, i, ts.Thresholds[i].Index())
 				assert.Equal(t, data.abortOnFail, ts.Thresholds[i].AbortOnFail)
 				assert.Equal(t, data.gracePeriod, ts.Thresholds[i].AbortGracePeriod)
 			}
@@ -314,6 +1786,72 @@ func TestThresholdsJSON(t *testing.T) {
 		})
 	}
 
+	t.Run("unknown fields", func(t *testing.T) {
+		input := `[{"threshold":"rate<0.01","abortOnFail":true,"future":{"a":[1,2]}}, "1+1==2"]`
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(input), &ts))
+		assert.Len(t, ts.Thresholds, 2)
+		assert.Equal(t, 0, ts.Thresholds[0].Index())
+		assert.Equal(t, 1, ts.Thresholds[1].Index())
+
+		data, err := MarshalJSONWithoutHTMLEscape(ts)
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"threshold":"rate<0.01","abortOnFail":true,"future":{"a":[1,2]}},"1+1==2"]`, string(data))
+
+		ts.Thresholds[0].AbortOnFail = false
+		data, err = MarshalJSONWithoutHTMLEscape(ts)
+		assert.NoError(t, err)
+		assert.Equal(t, `["rate<0.01","1+1==2"]`, string(data))
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		input := `[{"threshold":"rate<0.01","delayAbortEval":null,"tags":{"severity":"critical","team":"payments"}},"1+1==2"]`
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(input), &ts))
+		assert.Equal(t, map[string]string{"severity": "critical", "team": "payments"}, ts.Thresholds[0].Tags())
+		assert.Nil(t, ts.Thresholds[1].Tags())
+
+		ts.Thresholds[0].Tags()["team"] = "other"
+		data, err := MarshalJSONWithoutHTMLEscape(ts)
+		assert.NoError(t, err)
+		assert.Equal(t,
+			`[{"threshold":"rate<0.01","abortOnFail":false,"delayAbortEval":null,"tags":{"severity":"critical","team":"payments"}},"1+1==2"]`,
+			string(data))
+
+		var bad Thresholds
+		assert.Error(t, json.Unmarshal([]byte(`[{"threshold":"rate<0.01","tags":{"team":1}}]`), &bad))
+	})
+
+	t.Run("direction", func(t *testing.T) {
+		input := `[{"threshold":"rate>0.99","abortOnFail":false,"delayAbortEval":null,"direction":"lower"},` +
+			`"rate>0.99","p(95) <= 200","200 > p(95)","1+1==2"]`
+		var ts Thresholds
+		assert.NoError(t, json.Unmarshal([]byte(input), &ts))
+		expected := []struct{ configured, result ThresholdDirection }{
+			{LowerIsBetter, LowerIsBetter},
+			{UnknownDirection, HigherIsBetter},
+			{UnknownDirection, LowerIsBetter},
+			{UnknownDirection, UnknownDirection},
+			{UnknownDirection, UnknownDirection},
+		}
+		for i, e := range expected {
+			assert.Equal(t, e.configured, ts.Thresholds[i].Direction, ts.Thresholds[i].Source)
+			assert.Equal(t, e.result, ts.Thresholds[i].ResultDirection(), ts.Thresholds[i].Source)
+		}
+
+		data, err := MarshalJSONWithoutHTMLEscape(ts)
+		assert.NoError(t, err)
+		assert.Equal(t, input, string(data))
+
+		ts.Thresholds[1].Direction = HigherIsBetter
+		data, err = MarshalJSONWithoutHTMLEscape(Thresholds{Thresholds: ts.Thresholds[1:2]})
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"threshold":"rate>0.99","abortOnFail":false,"delayAbortEval":null,"direction":"higher"}]`, string(data))
+
+		var bad Thresholds
+		assert.Error(t, json.Unmarshal([]byte(`[{"threshold":"rate>0.99","direction":"sideways"}]`), &bad))
+	})
+
 	t.Run("bad JSON", func(t *testing.T) {
 		var ts Thresholds
 		assert.Error(t, json.Unmarshal([]byte("42"), &ts))
@@ -330,3 +1868,237 @@ func TestThresholdsJSON(t *testing.T) {
 		assert.False(t, ts.Abort)
 	})
 }
+
+func TestThresholdsRunSuggestion(t *testing.T) {
+	testdata := map[string]string{
+		"averag<100":  "did you mean 'avg'?",
+		"meadian<100": "did you mean 'med'?",
+		"p95<100":     "percentiles use the p(95) syntax",
+		"foo<100":     "",
+	}
+	sink := &TrendSink{}
+	sink.Add(Sample{Value: 1})
+	for src, suggestion := range testdata {
+		src, suggestion := src, suggestion
+		t.Run(src, func(t *testing.T) {
+			ts, err := NewThresholds([]string{src})
+			assert.NoError(t, err)
+			_, err = ts.Run(sink, 0)
+			assert.Error(t, err)
+			if suggestion == "" {
+				assert.NotContains(t, err.Error(), "; ")
+			} else {
+				assert.Contains(t, err.Error(), "; "+suggestion)
+			}
+		})
+	}
+}
+
+func TestThresholdsMarshalResults(t *testing.T) {
+	ts, err := NewThresholds([]string{"rate<0.01", "rate>0.5"})
+	assert.NoError(t, err)
+	ts.Thresholds[1].AbortOnFail = true
+
+	b, err := ts.Run(DummySink{"rate": 0.005}, 0)
+	assert.NoError(t, err)
+	assert.False(t, b)
+
+	data, err := ts.MarshalResults("http_req_failed")
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`[{"name":"http_req_failed","source":"rate<0.01","lastFailed":false,"abortOnFail":false},`+
+			`{"name":"http_req_failed","source":"rate>0.5","lastFailed":true,"abortOnFail":true}]`,
+		string(data))
+}
+
+func TestNewThresholdsFromInterface(t *testing.T) {
+	testdata := []struct {
+		input       []interface{}
+		srcs        []string
+		abortOnFail bool
+		gracePeriod types.NullDuration
+	}{
+		{[]interface{}{}, []string{}, false, types.NullDuration{}},
+		{[]interface{}{"1+1==2"}, []string{"1+1==2"}, false, types.NullDuration{}},
+		{[]interface{}{"rate<0.01"}, []string{"rate<0.01"}, false, types.NullDuration{}},
+		{[]interface{}{"1+1==2", "1+1==3"}, []string{"1+1==2", "1+1==3"}, false, types.NullDuration{}},
+		{
+			[]interface{}{map[string]interface{}{"threshold": "1+1==2"}},
+			[]string{"1+1==2"}, false, types.NullDuration{},
+		},
+		{
+			[]interface{}{map[string]interface{}{"threshold": "1+1==2", "abortOnFail": true, "delayAbortEval": nil}},
+			[]string{"1+1==2"}, true, types.NullDuration{},
+		},
+		{
+			[]interface{}{map[string]interface{}{"threshold": "1+1==2", "abortOnFail": true, "delayAbortEval": "2s"}},
+			[]string{"1+1==2"}, true, types.NullDurationFrom(2 * time.Second),
+		},
+		{
+			[]interface{}{map[interface{}]interface{}{"threshold": "1+1==2", "abortOnFail": true, "delayAbortEval": 2000}},
+			[]string{"1+1==2"}, true, types.NullDurationFrom(2 * time.Second),
+		},
+		{
+			[]interface{}{map[string]interface{}{"threshold": "1+1==2", "abortOnFail": false}},
+			[]string{"1+1==2"}, false, types.NullDuration{},
+		},
+		{
+			[]interface{}{map[string]interface{}{"threshold": "1+1==2"}, "1+1==3"},
+			[]string{"1+1==2", "1+1==3"}, false, types.NullDuration{},
+		},
+	}
+
+	for _, data := range testdata {
+		data := data
+		t.Run(fmt.Sprint(data.input), func(t *testing.T) {
+			ts, err := NewThresholdsFromInterface(data.input)
+			assert.NoError(t, err)
+			assert.Equal(t, len(data.srcs), len(ts.Thresholds))
+			for i, src := range data.srcs {
+				assert.Equal(t, src, ts.Thresholds[i].Source)
+				assert.Equal(t, data.abortOnFail, ts.Thresholds[i].AbortOnFail)
+				assert.Equal(t, data.gracePeriod, ts.Thresholds[i].AbortGracePeriod)
+			}
+		})
+	}
+
+	t.Run("interval and minSamples", func(t *testing.T) {
+		ts, err := NewThresholdsFromInterface([]interface{}{
+			map[string]interface{}{
+				"threshold": "count>0", "interval": true, "minSamples": float64(10), "requireSamples": true,
+				"tags": map[string]interface{}{"team": "payments"}, "direction": "higher",
+			},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ts.Thresholds[0].Interval)
+		assert.Equal(t, int64(10), ts.Thresholds[0].MinSamples)
+		assert.True(t, ts.Thresholds[0].RequireSamples)
+		assert.Equal(t, map[string]string{"team": "payments"}, ts.Thresholds[0].Tags())
+		assert.Equal(t, HigherIsBetter, ts.Thresholds[0].Direction)
+	})
+
+	for name, input := range map[string]interface{}{
+		"not a list":     "1+1==2",
+		"bad element":    []interface{}{42},
+		"bad field":      []interface{}{map[string]interface{}{"threshold": 42}},
+		"bad duration":   []interface{}{map[string]interface{}{"threshold": "1+1==2", "delayAbortEval": "2x"}},
+		"bad minSamples": []interface{}{map[string]interface{}{"threshold": "1+1==2", "minSamples": 1.5}},
+		"bad source":     []interface{}{"="},
+	} {
+		input := input
+		t.Run(name, func(t *testing.T) {
+			ts, err := NewThresholdsFromInterface(input)
+			assert.Error(t, err)
+			assert.Nil(t, ts.Thresholds)
+		})
+	}
+}
+
+func TestEncodeJSONWithoutHTMLEscape(t *testing.T) {
+	ts, err := NewThresholds([]string{"rate<0.01", "p(95)>=200 && avg<100"})
+	assert.NoError(t, err)
+	for _, v := range []interface{}{ts, "<&>", []int{1, 2}, nil} {
+		expected, err := MarshalJSONWithoutHTMLEscape(v)
+		assert.NoError(t, err)
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, EncodeJSONWithoutHTMLEscape(buf, v))
+		assert.Equal(t, string(expected), buf.String())
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, EncodeJSONWithoutHTMLEscape(buf, ts))
+	assert.Equal(t, `["rate<0.01","p(95)>=200 && avg<100"]`, buf.String())
+
+	assert.Error(t, EncodeJSONWithoutHTMLEscape(buf, func() {}))
+}
+
+var benchmarkThresholdSources = map[string][]string{
+	"rate":       {"rate<0.01"},
+	"percentile": {"p(95)<200"},
+	"list": {
+		"avg<100", "med<100", "min>0", "max<500", "p(90)<150", "p(95)<200", "p(99)<300",
+		"p(99.9)<400", "max>10", "avg<200 && p(95)<300", "p(90,95,99)<500",
+	},
+}
+
+func BenchmarkNewThresholds(b *testing.B) {
+	for name, sources := range benchmarkThresholdSources {
+		sources := sources
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := NewThresholds(sources)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkParseThresholdAST(b *testing.B) {
+	for _, src := range []string{"rate<0.01", "p(95) < 200", "avg<200 && p(95)<300"} {
+		src := src
+		b.Run(src, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := ParseThresholdAST(src)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkThresholdsRun(b *testing.B) {
+	trend, rate := &TrendSink{}, &RateSink{}
+	for i := 0; i < 1000; i++ {
+		trend.Add(Sample{Value: float64(i % 100)})
+		rate.Add(Sample{Value: float64(i % 2)})
+	}
+	for name, sources := range benchmarkThresholdSources {
+		var sink Sink = trend
+		if name == "rate" {
+			sink = rate
+		}
+		sources := sources
+		b.Run(name, func(b *testing.B) {
+			ts, err := NewThresholds(sources)
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := ts.Run(sink, time.Second)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// BenchmarkThresholdsRunAll measures only the evaluation of the thresholds, with the sink values
+// already set in the VM
+func BenchmarkThresholdsRunAll(b *testing.B) {
+	values := map[string]float64{
+		"rate": 0.005, "count": 1000, "avg": 50, "med": 50, "min": 0, "max": 99,
+		"p(90)": 90, "p(95)": 95, "p(99)": 99, "p(99.9)": 99.9,
+	}
+	for name, sources := range benchmarkThresholdSources {
+		sources := sources
+		b.Run(name, func(b *testing.B) {
+			ts, err := NewThresholds(sources)
+			require.NoError(b, err)
+			_, err = ts.RunWithValues(values, time.Second)
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := ts.runAll(context.Background(), time.Second)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkThresholdEvaluate(b *testing.B) {
+	ts, err := NewThresholds([]string{"p(95)<200 && avg<100"})
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ts.Thresholds[0].Evaluate(50)
+		require.NoError(b, err)
+	}
+}